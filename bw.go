@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// 限速时段，From/To 为 "HH:MM"，To 早于 From 时跨零点；Rate 为 KB/s，0 为不限
+type BwR struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Rate int    `json:"rate"`
+}
+
+type bwW struct {
+	from, to int   // 当天分钟数
+	rate     int64 // B/s
+}
+
+// 所有 worker 共用的令牌桶，速率按时段取，桶容量为 1 秒的量
+type Lim struct {
+	mu   sync.Mutex
+	base int64
+	sch  []bwW
+	tok  float64
+	last time.Time
+}
+
+// 不限速时返回 nil
+func mkLim(kb int, sch []BwR) (*Lim, error) {
+	if kb <= 0 && len(sch) == 0 {
+		return nil, nil
+	}
+	l := &Lim{base: int64(kb) << 10}
+	for _, r := range sch {
+		f, err := prsHM(r.From)
+		if err != nil {
+			return nil, err
+		}
+		t, err := prsHM(r.To)
+		if err != nil {
+			return nil, err
+		}
+		if r.Rate < 0 {
+			return nil, fmt.Errorf("bw rate %d: bad", r.Rate)
+		}
+		l.sch = append(l.sch, bwW{from: f, to: t, rate: int64(r.Rate) << 10})
+	}
+	return l, nil
+}
+
+func prsHM(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("bw time %q: %w", s, err)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// 当前速率，命中的第一个时段优先，都不命中用 base
+func (l *Lim) rate(now time.Time) int64 {
+	m := now.Hour()*60 + now.Minute()
+	for _, w := range l.sch {
+		in := m >= w.from && m < w.to
+		if w.to < w.from {
+			in = m >= w.from || m < w.to
+		}
+		if in {
+			return w.rate
+		}
+	}
+	return l.base
+}
+
+// 取 n 个令牌，不够时先欠着，按欠的量睡
+func (l *Lim) Wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	r := l.rate(now)
+	if r <= 0 {
+		l.tok = 0
+		l.last = now
+		l.mu.Unlock()
+		return nil
+	}
+	if !l.last.IsZero() {
+		l.tok += now.Sub(l.last).Seconds() * float64(r)
+	}
+	if l.tok > float64(r) {
+		l.tok = float64(r)
+	}
+	l.last = now
+	l.tok -= float64(n)
+	var d time.Duration
+	if l.tok < 0 {
+		d = time.Duration(-l.tok / float64(r) * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// 包一层限速读，l 为 nil 时原样返回
+func (l *Lim) R(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limR{ctx: ctx, r: r, l: l}
+}
+
+type limR struct {
+	ctx context.Context
+	r   io.Reader
+	l   *Lim
+}
+
+func (r *limR) Read(p []byte) (int, error) {
+	// 单次读太大时限速会一顿一顿的
+	if len(p) > 32<<10 {
+		p = p[:32<<10]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if e := r.l.Wait(r.ctx, n); e != nil {
+			return n, e
+		}
+	}
+	return n, err
+}
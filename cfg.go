@@ -19,6 +19,55 @@ type Cfg struct {
 	Typ   string   `json:"typ"`
 	List  []string `json:"list"`
 	Debug bool     `json:"debug"`
+	Inc   []string `json:"inc"`
+	Exc   []string `json:"exc"`
+	Ext   []string `json:"ext"`
+
+	KeepJunk bool `json:"keep_junk"`
+	State    bool `json:"state"`
+	Vfy      bool `json:"verify"`
+	Resume   int  `json:"resume"`
+	MaxDel   int  `json:"max_del"`
+	Dry      bool `json:"dry"`
+
+	Lnk string `json:"lnk"`
+	Sym string `json:"sym"`
+
+	Zip    string   `json:"zip"`
+	ZipExc []string `json:"zip_exc"`
+	Key    string   `json:"key"`
+
+	Pack    int `json:"pack"`
+	PackMax int `json:"pack_max"`
+
+	Bw    int   `json:"bw"`
+	BwSch []BwR `json:"bw_sch"`
+
+	MaxCon  int `json:"max_con"`
+	MetaCon int `json:"meta_con"`
+
+	Prog int `json:"prog"`
+
+	Rpt    string `json:"report"`
+	RptAll bool   `json:"report_all"`
+	RptUp  bool   `json:"report_up"`
+
+	Log     string `json:"log"`
+	LogLv   string `json:"log_lv"`
+	LogMax  int    `json:"log_max"`
+	LogKeep int    `json:"log_keep"`
+
+	Retry Try `json:"retry"`
+
+	Snap    bool   `json:"snap"`
+	SnapFmt string `json:"snap_fmt"`
+	Keep    Keep   `json:"keep"`
+
+	flt  *Flt
+	zexc map[string]struct{}
+	ek   *Ek
+	lim  *Lim
+	meta Sem
 }
 
 const mag = "CFG_TAIL1"
@@ -80,9 +129,54 @@ func rdCfg(exe string) (*Cfg, error) {
 	if m == "" {
 		m = "over"
 	}
-	if m != "over" && m != "skip" {
+	if m != "over" && m != "skip" && m != "newer" && m != "mirror" {
 		return nil, fmt.Errorf("cfg mode bad")
 	}
 	c.Mode = m
+	l := strings.ToLower(strings.TrimSpace(c.Lnk))
+	if l == "" {
+		l = "skip"
+	}
+	if l != "skip" && l != "keep" && l != "follow" {
+		return nil, fmt.Errorf("cfg lnk bad")
+	}
+	c.Lnk = l
+	y := strings.ToLower(strings.TrimSpace(c.Sym))
+	if y == "" {
+		y = "skip"
+	}
+	if y != "skip" && y != "follow" && y != "record" {
+		return nil, fmt.Errorf("cfg sym bad")
+	}
+	c.Sym = y
+	z := strings.ToLower(strings.TrimSpace(c.Zip))
+	if z != "" && z != "gzip" {
+		return nil, fmt.Errorf("cfg zip bad")
+	}
+	c.Zip = z
+	c.zexc = mkZipExc(c.ZipExc)
+	lim, err := mkLim(c.Bw, c.BwSch)
+	if err != nil {
+		return nil, fmt.Errorf("cfg %w", err)
+	}
+	c.lim = lim
+	if c.Key != "" {
+		ek, err := mkEk(c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("cfg key: %w", err)
+		}
+		c.ek = ek
+	}
+	if c.Snap && m == "mirror" {
+		return nil, fmt.Errorf("cfg snap with mirror mode")
+	}
+	if err := ckSnap(c.SnapFmt); err != nil {
+		return nil, fmt.Errorf("cfg %w", err)
+	}
+	flt, err := mkFlt(&c)
+	if err != nil {
+		return nil, fmt.Errorf("cfg filter bad: %w", err)
+	}
+	c.flt = flt
 	return &c, nil
 }
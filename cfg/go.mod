@@ -2,4 +2,4 @@ module cfg
 
 go 1.20
 
-require github.com/webview/webview_go v0.0.0-20240831120633-6173450d4dd6 // indirect
+require github.com/webview/webview_go v0.0.0-20240831120633-6173450d4dd6
@@ -9,8 +9,10 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
+	"time"
 
 	webview "github.com/webview/webview_go"
 )
@@ -25,6 +27,71 @@ type Cfg struct {
 	Typ   string   `json:"typ"`
 	List  []string `json:"list"`
 	Debug bool     `json:"debug"`
+	Inc   []string `json:"inc"`
+	Exc   []string `json:"exc"`
+	Ext   []string `json:"ext"`
+
+	KeepJunk bool `json:"keep_junk"`
+	State    bool `json:"state"`
+	Vfy      bool `json:"verify"`
+	Resume   int  `json:"resume"`
+	MaxDel   int  `json:"max_del"`
+	Dry      bool `json:"dry"`
+
+	Lnk string `json:"lnk"`
+	Sym string `json:"sym"`
+
+	Zip    string   `json:"zip"`
+	ZipExc []string `json:"zip_exc"`
+	Key    string   `json:"key"`
+
+	Pack    int `json:"pack"`
+	PackMax int `json:"pack_max"`
+
+	Bw    int   `json:"bw"`
+	BwSch []BwR `json:"bw_sch"`
+
+	MaxCon  int `json:"max_con"`
+	MetaCon int `json:"meta_con"`
+
+	Prog int `json:"prog"`
+
+	Rpt    string `json:"report"`
+	RptAll bool   `json:"report_all"`
+	RptUp  bool   `json:"report_up"`
+
+	Log     string `json:"log"`
+	LogLv   string `json:"log_lv"`
+	LogMax  int    `json:"log_max"`
+	LogKeep int    `json:"log_keep"`
+
+	Retry Try `json:"retry"`
+
+	Snap    bool   `json:"snap"`
+	SnapFmt string `json:"snap_fmt"`
+	Keep    Keep   `json:"keep"`
+}
+
+// 限速时段，Rate 为 KB/s
+type BwR struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Rate int    `json:"rate"`
+}
+
+// 重试策略，0 为默认值
+type Try struct {
+	Max  int `json:"max"`
+	Base int `json:"base_ms"`
+	Cap  int `json:"max_ms"`
+	Jit  int `json:"jitter"`
+}
+
+// 快照保留策略
+type Keep struct {
+	Last int `json:"last"`
+	Day  int `json:"day"`
+	Week int `json:"week"`
 }
 
 const mag = "CFG_TAIL1"
@@ -161,18 +228,173 @@ func ckCfg(c *Cfg) error {
 	if len(c.List) == 0 {
 		return errors.New("cfg list empty")
 	}
+	c.Mode = strings.ToLower(strings.TrimSpace(c.Mode))
 	if c.Mode == "" {
 		c.Mode = "skip"
 	}
+	if c.Mode != "over" && c.Mode != "skip" && c.Mode != "newer" && c.Mode != "mirror" {
+		return fmt.Errorf("cfg mode bad: %s", c.Mode)
+	}
 	if c.Thr <= 0 {
 		c.Thr = 4
 	}
 	if c.Typ == "" {
 		c.Typ = "dav"
 	}
+	c.Lnk = strings.ToLower(strings.TrimSpace(c.Lnk))
+	if c.Lnk == "" {
+		c.Lnk = "skip"
+	}
+	if c.Lnk != "skip" && c.Lnk != "keep" && c.Lnk != "follow" {
+		return fmt.Errorf("cfg lnk bad: %s", c.Lnk)
+	}
+	c.Sym = strings.ToLower(strings.TrimSpace(c.Sym))
+	if c.Sym == "" {
+		c.Sym = "skip"
+	}
+	if c.Sym != "skip" && c.Sym != "follow" && c.Sym != "record" {
+		return fmt.Errorf("cfg sym bad: %s", c.Sym)
+	}
+	c.Zip = strings.ToLower(strings.TrimSpace(c.Zip))
+	if c.Zip != "" && c.Zip != "gzip" {
+		return fmt.Errorf("cfg zip bad: %s", c.Zip)
+	}
+	for _, e := range c.ZipExc {
+		if strings.ContainsAny(e, `/\`) {
+			return fmt.Errorf("cfg zip_exc %q: bad", e)
+		}
+	}
+	if c.Snap && c.Mode == "mirror" {
+		return errors.New("cfg snap with mirror mode")
+	}
+	if strings.ContainsAny(c.SnapFmt, `/\`) {
+		return fmt.Errorf("cfg snap_fmt %q: must not contain /", c.SnapFmt)
+	}
+	if c.Resume < 0 {
+		c.Resume = 0
+	}
+	if c.Pack < 0 {
+		c.Pack = 0
+	}
+	if c.PackMax < 0 {
+		c.PackMax = 0
+	}
+	if c.Bw < 0 {
+		c.Bw = 0
+	}
+	if c.MaxCon < 0 {
+		c.MaxCon = 0
+	}
+	if c.MetaCon < 0 {
+		c.MetaCon = 0
+	}
+	if c.Prog < 0 {
+		c.Prog = -1
+	}
+	if c.MaxDel < 0 {
+		c.MaxDel = -1
+	}
+	switch c.LogLv {
+	case "", "error", "warn", "info", "debug":
+	default:
+		return fmt.Errorf("cfg log_lv %q: want error/warn/info/debug", c.LogLv)
+	}
+	if c.LogMax < 0 {
+		c.LogMax = 0
+	}
+	if c.LogKeep < 0 {
+		c.LogKeep = 0
+	}
+	if c.Retry.Max < 0 || c.Retry.Base < 0 || c.Retry.Cap < 0 {
+		return errors.New("cfg retry: negative value")
+	}
+	if c.Retry.Jit > 100 {
+		return fmt.Errorf("cfg retry jitter %d: want <= 100", c.Retry.Jit)
+	}
+	for _, r := range c.BwSch {
+		for _, t := range []string{r.From, r.To} {
+			if _, err := time.Parse("15:04", t); err != nil {
+				return fmt.Errorf("cfg bw_sch time %q: bad", t)
+			}
+		}
+		if r.Rate < 0 {
+			return fmt.Errorf("cfg bw_sch rate %d: bad", r.Rate)
+		}
+	}
+	for _, p := range c.Inc {
+		if err := ckPat(p); err != nil {
+			return fmt.Errorf("cfg inc %q: %w", p, err)
+		}
+	}
+	for _, p := range c.Exc {
+		if err := ckPat(p); err != nil {
+			return fmt.Errorf("cfg exc %q: %w", p, err)
+		}
+	}
+	for _, e := range c.Ext {
+		if strings.ContainsAny(e, `/\`) {
+			return fmt.Errorf("cfg ext %q: bad", e)
+		}
+	}
 	return nil
 }
 
+// 校验过滤规则，"re:" 前缀为正则，否则为通配符
+func ckPat(p string) error {
+	p = strings.TrimSpace(p)
+	if p == "" {
+		return nil
+	}
+	if strings.HasPrefix(p, "re:") {
+		_, err := regexp.Compile(p[3:])
+		return err
+	}
+	p = strings.Trim(strings.ReplaceAll(p, `\`, "/"), "/")
+	_, err := regexp.Compile(glob2re(p))
+	return err
+}
+
+// 与 WDBak 的通配符规则保持一致
+func glob2re(g string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(g); i++ {
+		c := g[i]
+		switch c {
+		case '*':
+			if i+1 < len(g) && g[i+1] == '*' {
+				i++
+				if i+1 < len(g) && g[i+1] == '/' {
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			j := strings.IndexByte(g[i+1:], ']')
+			if j < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			cls := g[i+1 : i+1+j]
+			if strings.HasPrefix(cls, "!") {
+				cls = "^" + cls[1:]
+			}
+			b.WriteString("[" + cls + "]")
+			i += j + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
 // 构造带尾巴的新buf，去掉旧尾巴再加新的
 func mkBuf(dat, js []byte) ([]byte, error) {
 	if len(js) > 1<<31-1 {
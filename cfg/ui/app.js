@@ -24,17 +24,39 @@
       });
   }
 
-  function cfgGet() {
-    const tStr = $("thr").value.trim();
-    let thr = parseInt(tStr, 10);
-    if (!thr || thr < 1) thr = 4;
-
-    const raw = $("list").value.split(/\r?\n/);
+  function lnGet(id) {
+    const raw = $(id).value.split(/\r?\n/);
     const lst = [];
     for (let i = 0; i < raw.length; i++) {
       const v = raw[i].trim();
       if (v) lst.push(v);
     }
+    return lst;
+  }
+
+  function numGet(id) {
+    const n = parseInt($(id).value.trim(), 10);
+    return !n || n < 0 ? 0 : n;
+  }
+
+  // "08:00-18:00 2048" 每行一段
+  function schGet(id) {
+    const out = [];
+    const lst = lnGet(id);
+    for (let i = 0; i < lst.length; i++) {
+      const m = lst[i].match(/^(\d{1,2}:\d{2})\s*-\s*(\d{1,2}:\d{2})\s+(\d+)$/);
+      if (!m) continue;
+      out.push({ from: m[1].padStart(5, "0"), to: m[2].padStart(5, "0"), rate: parseInt(m[3], 10) });
+    }
+    return out;
+  }
+
+  function cfgGet() {
+    const tStr = $("thr").value.trim();
+    let thr = parseInt(tStr, 10);
+    if (!thr || thr < 1) thr = 4;
+
+    const lst = lnGet("list");
 
     return {
       url: $("url").value.trim(),
@@ -46,6 +68,51 @@
       typ: $("typ").value,
       list: lst,
       debug: $("debug").checked,
+      inc: lnGet("inc"),
+      exc: lnGet("exc"),
+      ext: $("ext").value.split(/[,\s]+/).filter(function (v) {
+        return v !== "";
+      }),
+      keep_junk: $("keep_junk").checked,
+      lnk: $("lnk").value,
+      sym: $("sym").value,
+      zip: $("zip").value,
+      key: $("key").value,
+      zip_exc: $("zip_exc").value.split(/[,\s]+/).filter(function (v) {
+        return v !== "";
+      }),
+      state: $("state").checked,
+      verify: $("verify").checked,
+      dry: $("dry").checked,
+      resume: numGet("resume"),
+      max_del: parseInt($("max_del").value.trim(), 10) || 0,
+      pack: numGet("pack"),
+      pack_max: numGet("pack_max"),
+      bw: numGet("bw"),
+      max_con: numGet("max_con"),
+      meta_con: numGet("meta_con"),
+      prog: parseInt($("prog").value.trim(), 10) || 0,
+      report: $("report").value.trim(),
+      report_all: $("report_all").checked,
+      report_up: $("report_up").checked,
+      log: $("log").value.trim(),
+      log_lv: $("log_lv").value,
+      log_max: numGet("log_max"),
+      log_keep: numGet("log_keep"),
+      bw_sch: schGet("bw_sch"),
+      retry: {
+        max: numGet("retry_max"),
+        base_ms: numGet("retry_base"),
+        max_ms: numGet("retry_cap"),
+        jitter: parseInt($("retry_jit").value.trim(), 10) || 0,
+      },
+      snap: $("snap").checked,
+      snap_fmt: $("snap_fmt").value.trim(),
+      keep: {
+        last: numGet("keep_last"),
+        day: numGet("keep_day"),
+        week: numGet("keep_week"),
+      },
     };
   }
 
@@ -110,11 +177,48 @@
     $("url").value = "";
     $("user").value = "";
     $("pass").value = "";
+    $("key").value = "";
     $("root").value = "";
     $("mode").value = "skip";
     $("typ").value = "dav";
     $("thr").value = "4";
     $("list").value = "";
+    $("inc").value = "";
+    $("exc").value = "";
+    $("ext").value = "";
+    $("zip_exc").value = "";
+    $("keep_junk").checked = false;
+    $("lnk").value = "skip";
+    $("sym").value = "skip";
+    $("zip").value = "";
+    $("state").checked = false;
+    $("verify").checked = false;
+    $("dry").checked = false;
+    $("resume").value = "0";
+    $("max_del").value = "0";
+    $("pack").value = "0";
+    $("pack_max").value = "0";
+    $("bw").value = "0";
+    $("max_con").value = "0";
+    $("meta_con").value = "0";
+    $("prog").value = "0";
+    $("report").value = "";
+    $("report_all").checked = false;
+    $("report_up").checked = false;
+    $("log").value = "";
+    $("log_lv").value = "";
+    $("log_max").value = "0";
+    $("log_keep").value = "0";
+    $("retry_max").value = "0";
+    $("retry_base").value = "0";
+    $("retry_cap").value = "0";
+    $("retry_jit").value = "0";
+    $("bw_sch").value = "";
+    $("snap").checked = false;
+    $("snap_fmt").value = "";
+    $("keep_last").value = "0";
+    $("keep_day").value = "0";
+    $("keep_week").value = "0";
     $("debug").checked = false;
     msgSet("", null);
     defFill();
@@ -131,6 +235,8 @@
     $("typ").value = "dav";
     $("thr").value = "4";
     $("debug").checked = false;
+    $("lnk").value = "skip";
+    $("sym").value = "skip";
 
     defFill();
   });
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"strings"
+)
+
+// 已知服务的安全并发，con 为上传连接数，meta 为同时进行的 Mk/Has/Stat 数，0 为不限
+type prof struct {
+	con  int
+	meta int
+	note string
+}
+
+// 按主机名匹配，子域名也算
+var profs = map[string]prof{
+	"webdav.123pan.cn":   {con: 1, meta: 1, note: "123pan rejects parallel uploads"},
+	"dav.jianguoyun.com": {con: 2, meta: 2, note: "jianguoyun rate-limits requests"},
+}
+
+func findProf(u string) (string, prof, bool) {
+	h := ""
+	if x, err := url.Parse(u); err == nil {
+		h = strings.ToLower(x.Hostname())
+	}
+	for k, p := range profs {
+		if h == k || strings.HasSuffix(h, "."+k) {
+			return k, p, true
+		}
+	}
+	return "", prof{}, false
+}
+
+// 按 max_con/meta_con 和内置表确定并发，配置了的优先于表
+func apCon(cfg *Cfg) {
+	k, p, ok := findProf(cfg.Url)
+	switch {
+	case cfg.MaxCon > 0:
+		cfg.Thr = cfg.MaxCon
+	case ok && p.con > 0 && cfg.Thr > p.con:
+		log.Printf("[WRN] thr=%d exceeds safe limit %d for %s (%s), using %d\n", cfg.Thr, p.con, k, p.note, p.con)
+		cfg.Thr = p.con
+	}
+	meta := cfg.MetaCon
+	if meta <= 0 && ok {
+		meta = p.meta
+	}
+	cfg.meta = mkSem(meta)
+}
+
+// 计数信号量，nil 时不限
+type Sem chan struct{}
+
+func mkSem(n int) Sem {
+	if n <= 0 {
+		return nil
+	}
+	return make(Sem, n)
+}
+
+func (s Sem) Get(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s Sem) Put() {
+	if s != nil {
+		<-s
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// root 下的控制目录，放链接清单、打包索引等，mirror 不删，restore 不下载
+const ctlDir = ".wdbak"
+
+func isCtl(rel string) bool {
+	return rel == ctlDir || strings.HasPrefix(rel, ctlDir+"/")
+}
+
+// 从 src 往上找到 top 为止，返回最近一个含有 .wdbak/<n> 的目录
+// 快照模式下控制目录在快照目录里，恢复子目录时要往上找
+func ctlUp(ctx context.Context, sto Sto, src, top, n string) (string, *Ent, error) {
+	d := src
+	for {
+		rem := path.Join(d, ctlDir, n)
+		e, err := sto.Stat(ctx, rem)
+		if err != nil {
+			return "", nil, fmt.Errorf("stat %s: %w", rem, err)
+		}
+		if e != nil {
+			return d, e, nil
+		}
+		if d == top || d == "" {
+			return "", nil, nil
+		}
+		if d = path.Dir(d); d == "." || d == "/" {
+			d = ""
+		}
+	}
+}
+
+// 上传一段内存数据，失败按 doTry 重试
+func putB(ctx context.Context, sto Sto, dc *DirC, rem string, b []byte) error {
+	if err := mkDir(ctx, sto, dc, path.Dir(rem)); err != nil {
+		return fmt.Errorf("mkDir %s: %w", path.Dir(rem), err)
+	}
+	return doTry(ctx, func() error {
+		src := &Src{R: bytes.NewReader(b), L: path.Base(rem), Sz: int64(len(b)), Mt: time.Now()}
+		return sto.Put(ctx, src, rem)
+	})
+}
@@ -2,30 +2,39 @@ package main
 
 import (
 	"context"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type DavSto struct {
-	url string
-	usr string
-	pas string
-	cli *http.Client
+	url   string
+	usr   string
+	pas   string
+	cli   *http.Client
+	noRsm bool
+	noChk bool // 服务器不收 chunked，大小未知时先落盘
+	lim   *Lim
+	meta  Sem
 }
 
 func newDav(cfg *Cfg) (Sto, error) {
 	cli := mkCli(cfg.Thr)
 	u := strings.TrimRight(cfg.Url, "/")
 	return &DavSto{
-		url: u,
-		usr: cfg.User,
-		pas: cfg.Pass,
-		cli: cli,
+		url:  u,
+		usr:  cfg.User,
+		pas:  cfg.Pass,
+		cli:  cli,
+		lim:  cfg.lim,
+		meta: cfg.meta,
 	}, nil
 }
 
@@ -45,6 +54,26 @@ func mkCli(thr int) *http.Client {
 	}
 }
 
+// 非 2xx 响应按状态码分类
+func hE(op, u string, resp *http.Response) error {
+	var k error
+	switch c := resp.StatusCode; {
+	case c == 401:
+		k = ErrAuth
+	case c == 403:
+		k = ErrPermission
+	case c == 404 || c == 410:
+		k = ErrNotFound
+	case c == 412:
+		k = ErrExists
+	case c == 413 || c == 507:
+		k = ErrQuota
+	case c == 408 || c == 429 || c >= 500:
+		k = ErrTransient
+	}
+	return &StoE{Op: op, P: u, K: k, Err: errors.New(resp.Status)}
+}
+
 func (d *DavSto) Cls() {
 	if tr, ok := d.cli.Transport.(*http.Transport); ok {
 		tr.CloseIdleConnections()
@@ -55,9 +84,13 @@ func (d *DavSto) Mk(ctx context.Context, dir string) error {
 	if dir == "" {
 		return nil
 	}
+	if err := d.meta.Get(ctx); err != nil {
+		return err
+	}
+	defer d.meta.Put()
 	u := mkURL(d.url, dir)
 
-	return doTry(ctx, 3, func() error {
+	return doTry(ctx, func() error {
 		req, err := http.NewRequestWithContext(ctx, "MKCOL", u, nil)
 		if err != nil {
 			return err
@@ -76,17 +109,21 @@ func (d *DavSto) Mk(ctx context.Context, dir string) error {
 			return nil
 		}
 		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-			return fmt.Errorf("mkcol %s: %s", u, resp.Status)
+			return hE("mkcol", u, resp)
 		}
 		return nil
 	})
 }
 
 func (d *DavSto) Has(ctx context.Context, rem string) (bool, error) {
+	if err := d.meta.Get(ctx); err != nil {
+		return false, err
+	}
+	defer d.meta.Put()
 	u := mkURL(d.url, rem)
 
 	var ok bool
-	err := doTry(ctx, 3, func() error {
+	err := doTry(ctx, func() error {
 		req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
 		if err != nil {
 			return err
@@ -108,50 +145,351 @@ func (d *DavSto) Has(ctx context.Context, rem string) (bool, error) {
 			ok = true
 			return nil
 		}
-		return fmt.Errorf("head %s: %s", u, resp.Status)
+		return hE("head", u, resp)
 	})
 	return ok, err
 }
 
-func (d *DavSto) Put(ctx context.Context, loc, rem string, sz int64) error {
+func (d *DavSto) Put(ctx context.Context, src *Src, rem string) error {
 	u := mkURL(d.url, rem)
-	dbgLogf("[DBG] PUT %s -> %s (%d bytes)", loc, u, sz)
-	return doTry(ctx, 3, func() error {
-		f, err := os.Open(loc)
+	dbgLogf("[DBG] PUT %s -> %s (%d bytes)", src.L, u, src.Sz)
+
+	if src.Sz < 0 && d.noChk {
+		f, err := os.CreateTemp("", "wdbak-*")
+		if err != nil {
+			return err
+		}
+		defer func() {
+			f.Close()
+			os.Remove(f.Name())
+		}()
+		n, err := io.Copy(f, src.R)
 		if err != nil {
 			return err
 		}
-		defer f.Close()
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		src = &Src{R: f, L: src.L, Sz: n, Mt: src.Mt}
+	}
+
+	cr := &cntR{r: d.lim.R(ctx, src.R)}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, cr)
+	if err != nil {
+		return err
+	}
+	if d.usr != "" {
+		req.SetBasicAuth(d.usr, d.pas)
+	}
+	// -1 时按 chunked 发送
+	req.ContentLength = src.Sz
+	if !src.Mt.IsZero() {
+		// ownCloud/Nextcloud 会用它设置远端修改时间
+		req.Header.Set("X-OC-Mtime", strconv.FormatInt(src.Mt.Unix(), 10))
+	}
+
+	t0 := time.Now()
+	resp, err := d.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode == http.StatusLengthRequired && src.Sz < 0 {
+		// 本次的流已读掉，交给重试时落盘再传
+		d.noChk = true
+		return fmt.Errorf("put %s: %s, retry with length", u, resp.Status)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return hE("put", u, resp)
+	}
+
+	dur := time.Since(t0).Seconds()
+	if dur <= 0 {
+		dur = 0.001
+	}
+	mb := float64(cr.n) / 1024.0 / 1024.0
+	spd := mb / dur
+	dbgLogf("[OK ] %s -> %s (%.2f MB, %.1fs, %.2f MB/s)\n",
+		src.L, u, mb, dur, spd)
+	return nil
+}
+
+func (d *DavSto) Get(ctx context.Context, rem string) (io.ReadCloser, error) {
+	u := mkURL(d.url, rem)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if d.usr != "" {
+		req.SetBasicAuth(d.usr, d.pas)
+	}
+	resp, err := d.cli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, hE("get", u, resp)
+	}
+	return resp.Body, nil
+}
+
+// 续传用带 Content-Range 的 PUT，服务器拒绝后本 worker 不再尝试
+func (d *DavSto) PutAt(ctx context.Context, src *Src, rem string, off int64) error {
+	if d.noRsm {
+		return errNoRsm
+	}
+	u := mkURL(d.url, rem)
+	dbgLogf("[DBG] PUT %s -> %s (%d/%d bytes)", src.L, u, src.Sz-off, src.Sz)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, d.lim.R(ctx, src.R))
+	if err != nil {
+		return err
+	}
+	if d.usr != "" {
+		req.SetBasicAuth(d.usr, d.pas)
+	}
+	req.ContentLength = src.Sz - off
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, src.Sz-1, src.Sz))
+
+	resp, err := d.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	switch resp.StatusCode {
+	case 400, 405, 416, 501:
+		d.noRsm = true
+		return fmt.Errorf("put %s: %s: %w", u, resp.Status, errNoRsm)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return hE("put", u, resp)
+	}
+
+	// 有的服务器忽略 Content-Range 直接覆盖，传完核对大小
+	e, err := d.Stat(ctx, rem)
+	if err != nil {
+		return err
+	}
+	if e == nil || e.Sz != src.Sz {
+		d.noRsm = true
+		return fmt.Errorf("put %s: range ignored: %w", u, errNoRsm)
+	}
+	dbgLogf("[OK ] %s -> %s (resumed @%d)\n", src.L, u, off)
+	return nil
+}
+
+const pfBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop>
+<d:getcontentlength/><d:getlastmodified/><d:resourcetype/>
+</d:prop></d:propfind>`
+
+const pfSum = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns"><d:prop>
+<oc:checksums/>
+</d:prop></d:propfind>`
 
-		req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, f)
+type pfMs struct {
+	Rs []pfR `xml:"response"`
+}
+
+type pfR struct {
+	Href string `xml:"href"`
+	Ps   []pfPs `xml:"propstat"`
+}
+
+type pfPs struct {
+	St string `xml:"status"`
+	P  struct {
+		Sum []string `xml:"checksums>checksum"`
+		Len string   `xml:"getcontentlength"`
+		Mod string   `xml:"getlastmodified"`
+		Rt  struct {
+			Col *struct{} `xml:"collection"`
+		} `xml:"resourcetype"`
+	} `xml:"prop"`
+}
+
+// PROPFIND，不存在时返回 nil
+func (d *DavSto) pf(ctx context.Context, rem, dep, body string) ([]pfR, error) {
+	u := mkURL(d.url, rem)
+
+	var rs []pfR
+	err := doTry(ctx, func() error {
+		req, err := http.NewRequestWithContext(ctx, "PROPFIND", u, strings.NewReader(body))
 		if err != nil {
 			return err
 		}
 		if d.usr != "" {
 			req.SetBasicAuth(d.usr, d.pas)
 		}
-		req.ContentLength = sz
-
-		t0 := time.Now()
+		req.Header.Set("Depth", dep)
+		req.Header.Set("Content-Type", "application/xml; charset=utf-8")
 		resp, err := d.cli.Do(req)
 		if err != nil {
 			return err
 		}
 		defer resp.Body.Close()
-		_, _ = io.Copy(io.Discard, resp.Body)
 
+		if resp.StatusCode == 404 || resp.StatusCode == 410 {
+			rs = nil
+			return nil
+		}
+		if resp.StatusCode != 207 {
+			return hE("propfind", u, resp)
+		}
+		var ms pfMs
+		if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+			return fmt.Errorf("propfind %s: %w", u, err)
+		}
+		rs = ms.Rs
+		return nil
+	})
+	return rs, err
+}
+
+// 取 200 的 propstat 转成 Ent
+func (r *pfR) ent() *Ent {
+	for _, ps := range r.Ps {
+		if ps.St != "" && !strings.Contains(ps.St, " 200") {
+			continue
+		}
+		e := &Ent{Dir: ps.P.Rt.Col != nil}
+		e.Sz, _ = strconv.ParseInt(strings.TrimSpace(ps.P.Len), 10, 64)
+		e.Mt, _ = http.ParseTime(strings.TrimSpace(ps.P.Mod))
+		return e
+	}
+	return &Ent{}
+}
+
+func (d *DavSto) Stat(ctx context.Context, rem string) (*Ent, error) {
+	if err := d.meta.Get(ctx); err != nil {
+		return nil, err
+	}
+	defer d.meta.Put()
+	rs, err := d.pf(ctx, rem, "0", pfBody)
+	if err != nil || len(rs) == 0 {
+		return nil, err
+	}
+	e := rs[0].ent()
+	e.P = rem
+	return e, nil
+}
+
+func (d *DavSto) Ls(ctx context.Context, dir string, deep bool) ([]*Ent, error) {
+	bp := ""
+	if u, err := url.Parse(d.url); err == nil {
+		bp = strings.TrimRight(u.Path, "/")
+	}
+
+	var out []*Ent
+	var walk func(dir string) error
+	// 很多服务器禁用 Depth: infinity，逐层 Depth: 1
+	walk = func(dir string) error {
+		rs, err := d.pf(ctx, dir, "1", pfBody)
+		if err != nil {
+			return err
+		}
+		for i := range rs {
+			h, err := url.Parse(rs[i].Href)
+			if err != nil {
+				continue
+			}
+			p := strings.Trim(strings.TrimPrefix(h.Path, bp), "/")
+			if p == strings.Trim(dir, "/") {
+				continue
+			}
+			e := rs[i].ent()
+			e.P = p
+			out = append(out, e)
+			if e.Dir && deep {
+				if err := walk(p); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(dir); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// 先看 HEAD 的 OC-Checksum，没有再查 oc:checksums
+func (d *DavSto) Sum(ctx context.Context, rem string) (map[string]string, error) {
+	u := mkURL(d.url, rem)
+	m := make(map[string]string)
+
+	err := doTry(ctx, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+		if err != nil {
+			return err
+		}
+		if d.usr != "" {
+			req.SetBasicAuth(d.usr, d.pas)
+		}
+		resp, err := d.cli.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
 		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-			return fmt.Errorf("put %s: %s", u, resp.Status)
+			return hE("head", u, resp)
+		}
+		prsSum(resp.Header.Get("OC-Checksum"), m)
+		return nil
+	})
+	if err != nil || len(m) > 0 {
+		return m, err
+	}
+
+	rs, err := d.pf(ctx, rem, "0", pfSum)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rs {
+		for _, ps := range r.Ps {
+			for _, v := range ps.P.Sum {
+				prsSum(v, m)
+			}
+		}
+	}
+	return m, nil
+}
+
+// DAV 的 DELETE 对集合本身就是递归的
+func (d *DavSto) Del(ctx context.Context, rem string, dir bool) error {
+	u := mkURL(d.url, rem)
+	if dir {
+		u += "/"
+	}
+
+	return doTry(ctx, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodDelete, u, nil)
+		if err != nil {
+			return err
+		}
+		if d.usr != "" {
+			req.SetBasicAuth(d.usr, d.pas)
+		}
+		resp, err := d.cli.Do(req)
+		if err != nil {
+			return err
 		}
+		defer resp.Body.Close()
+		_, _ = io.Copy(io.Discard, resp.Body)
 
-		dur := time.Since(t0).Seconds()
-		if dur <= 0 {
-			dur = 0.001
+		if resp.StatusCode == 404 || resp.StatusCode == 410 {
+			return nil
+		}
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return hE("delete", u, resp)
 		}
-		mb := float64(sz) / 1024.0 / 1024.0
-		spd := mb / dur
-		dbgLogf("[OK ] %s -> %s (%.2f MB, %.1fs, %.2f MB/s)\n",
-			loc, u, mb, dur, spd)
 		return nil
 	})
 }
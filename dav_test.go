@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestHE(t *testing.T) {
+	tc := []struct {
+		code int
+		k    error
+		no   bool
+	}{
+		{400, nil, true},
+		{401, ErrAuth, true},
+		{403, ErrPermission, true},
+		{404, ErrNotFound, true},
+		{408, ErrTransient, false},
+		{409, nil, true},
+		{410, ErrNotFound, true},
+		{412, ErrExists, true},
+		{413, ErrQuota, true},
+		{429, ErrTransient, false},
+		{500, ErrTransient, false},
+		{502, ErrTransient, false},
+		{503, ErrTransient, false},
+		{507, ErrQuota, true},
+	}
+	for _, c := range tc {
+		resp := &http.Response{StatusCode: c.code, Status: http.StatusText(c.code)}
+		err := hE("put", "http://h/a", resp)
+		var se *StoE
+		if !errors.As(err, &se) {
+			t.Fatalf("%d: %v is not *StoE", c.code, err)
+		}
+		if se.K != c.k {
+			t.Errorf("%d: kind %v, want %v", c.code, se.K, c.k)
+		}
+		if c.k != nil && !errors.Is(err, c.k) {
+			t.Errorf("%d: errors.Is(%v) false", c.code, c.k)
+		}
+		if got := noTry(err); got != c.no {
+			t.Errorf("%d: noTry %v, want %v", c.code, got, c.no)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 本地状态库，记录每个远端文件上传时的本地大小和修改时间，以及上传后远端的修改时间
+type Rec struct {
+	Sz int64
+	Mt int64
+	Ok bool
+	Rt int64 // 远端修改时间，0 为不知道
+}
+
+// key 为去掉首尾 / 的远端路径，与 Ls 返回的一致
+type Db struct {
+	mu  sync.Mutex
+	p   string
+	m   map[string]Rec
+	chg bool
+}
+
+// 按 typ+url+root 区分本地状态文件，放在程序目录下
+func keyP(dir string, cfg *Cfg, ext string) string {
+	h := fnv.New64a()
+	h.Write([]byte(strings.ToLower(cfg.Typ) + "|" + cfg.Url + "|" + cfg.Root))
+	return filepath.Join(dir, fmt.Sprintf("WDBak-%016x%s", h.Sum64(), ext))
+}
+
+func opDb(p string) (*Db, error) {
+	d := &Db{p: p, m: make(map[string]Rec)}
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return d, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	if err := gob.NewDecoder(f).Decode(&d.m); err != nil {
+		// 损坏时当作空库，下次保存覆盖
+		log.Printf("[WRN] state %s: %v\n", p, err)
+		d.m = make(map[string]Rec)
+	}
+	return d, nil
+}
+
+func (d *Db) Get(rem string) (Rec, bool) {
+	if d == nil {
+		return Rec{}, false
+	}
+	d.mu.Lock()
+	r, ok := d.m[strings.Trim(rem, "/")]
+	d.mu.Unlock()
+	return r, ok
+}
+
+func (d *Db) Set(rem string, r Rec) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.m[strings.Trim(rem, "/")] = r
+	d.chg = true
+	d.mu.Unlock()
+}
+
+// 远端文件被删除后去掉记录
+func (d *Db) Del(rem string) {
+	if d == nil {
+		return
+	}
+	k := strings.Trim(rem, "/")
+	d.mu.Lock()
+	if _, ok := d.m[k]; ok {
+		delete(d.m, k)
+		d.chg = true
+	}
+	d.mu.Unlock()
+}
+
+// 零值时间记为 0
+func unixN(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// 本地文件和记录一致且上次上传成功
+func (d *Db) Same(rem string, st os.FileInfo) bool {
+	r, ok := d.Get(rem)
+	return ok && r.Ok && r.Sz == st.Size() && r.Mt == st.ModTime().UnixNano()
+}
+
+func (d *Db) Save() error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.chg {
+		return nil
+	}
+	tmp := d.p + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(d.m); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, d.p); err != nil {
+		return err
+	}
+	d.chg = false
+	return nil
+}
+
+// 运行中定期保存的间隔，程序崩溃时最多丢这么久的记录
+const dbIv = time.Minute
+
+// 每 dbIv 保存一次，调用返回的函数停止
+func (d *Db) auto() func() {
+	dn := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(dbIv)
+		defer t.Stop()
+		for {
+			select {
+			case <-dn:
+				return
+			case <-t.C:
+			}
+			if err := d.Save(); err != nil {
+				log.Printf("[WRN] state save: %v\n", err)
+			}
+		}
+	}()
+	return func() {
+		close(dn)
+		wg.Wait()
+	}
+}
+
+// 缓存丢失或过期时，用远端列表重建：远端存在且大小一致的文件视为已上传，压缩、加密的比修改时间
+func rebuild(ctx context.Context, cfg *Cfg, dir string) error {
+	sto, err := mkSto(cfg)
+	if err != nil {
+		return err
+	}
+	defer sto.Cls()
+
+	root := strings.Trim(cfg.Root, "/")
+	es, err := sto.Ls(ctx, root, true)
+	if err != nil {
+		return fmt.Errorf("ls %s: %w", root, err)
+	}
+	rm := make(map[string]*Ent, len(es))
+	for _, e := range es {
+		if !e.Dir {
+			rm[e.P] = e
+		}
+	}
+	log.Printf("remote files=%d\n", len(rm))
+
+	d := &Db{p: keyP(dir, cfg, ".db"), m: make(map[string]Rec), chg: true}
+	q := make(chan Job, 64)
+	go func() {
+		defer close(q)
+		for _, s := range cfg.List {
+			if ctx.Err() != nil {
+				return
+			}
+			if !filepath.IsAbs(s) {
+				s = filepath.Join(dir, s)
+			}
+			if _, err := addJob(ctx, cfg, s, q, nil); err != nil {
+				log.Printf("[ERR] add %s: %v\n", s, err)
+			}
+		}
+	}()
+
+	var n, hit int
+	for j := range q {
+		n++
+		st, err := os.Stat(j.L)
+		if err != nil {
+			continue
+		}
+		rem, z := zipRem(cfg, strings.Trim(remP(cfg, j.R), "/"))
+		rem, x := encRem(cfg, rem)
+		if e, ok := rm[rem]; ok && ((z || x) && !isNew(st, e, true, Rec{}, false) || !z && !x && e.Sz == st.Size()) {
+			d.m[rem] = Rec{Sz: st.Size(), Mt: st.ModTime().UnixNano(), Ok: true, Rt: unixN(e.Mt)}
+			hit++
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := d.Save(); err != nil {
+		return err
+	}
+	log.Printf("rebuild local=%d hit=%d -> %s\n", n, hit, d.p)
+	return nil
+}
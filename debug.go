@@ -1,31 +1,46 @@
 package main
 
 import (
+	"fmt"
 	"log"
-	"os"
+	"strings"
 )
 
-var dbg bool
+// 日志级别，按 [ERR]/[WRN] 前缀区分，其余为 info，dbgLogf 为 debug
+const (
+	lvErr = iota
+	lvWrn
+	lvInf
+	lvDbg
+)
+
+var lvN = map[string]int{"error": lvErr, "warn": lvWrn, "info": lvInf, "debug": lvDbg}
 
-func setDbg(enable bool) {
-	if enable && isTTY() {
-		dbg = true
-	} else {
-		dbg = false
+// s 为空时按 debug 开关取 info 或 debug
+func setLv(s string, debug bool) error {
+	lv := lvInf
+	if debug {
+		lv = lvDbg
+	}
+	if s != "" {
+		n, ok := lvN[strings.ToLower(s)]
+		if !ok {
+			return fmt.Errorf("log_lv %q: want error/warn/info/debug", s)
+		}
+		lv = n
 	}
+	lgw.mu.Lock()
+	lgw.lv = lv
+	lgw.mu.Unlock()
+	return nil
 }
 
 func dbgLogf(format string, args ...interface{}) {
-	if !dbg {
+	lgw.mu.Lock()
+	on := lgw.lv >= lvDbg
+	lgw.mu.Unlock()
+	if !on {
 		return
 	}
 	log.Printf(format, args...)
 }
-
-func isTTY() bool {
-	st, err := os.Stdout.Stat()
-	if err != nil {
-		return false
-	}
-	return st.Mode()&os.ModeCharDevice != 0
-}
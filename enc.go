@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// 加密格式 v1：
+// 头 "WDBK" | 版本 1 | scrypt 盐 16 | 文件盐 16
+// 之后每 64KB 明文一块 AES-256-GCM，nonce 为 8 字节块序号 + 3 字节 0 + 末块标记，头作为附加数据
+// 末块标记防截断，空文件也有一个空的末块
+const (
+	encSuf = ".enc"
+	encMag = "WDBK"
+	encVer = 1
+	encChk = 64 << 10
+	encSlt = 16
+	encHdr = len(encMag) + 1 + 2*encSlt
+	encTag = 16
+)
+
+var errEnc = errors.New("bad encrypted data")
+
+// 口令派生的密钥，本次运行用一个 scrypt 盐，解密时按头里的盐另算并缓存
+type Ek struct {
+	pass []byte
+	salt []byte
+	mk   []byte
+	mu   sync.Mutex
+	c    map[string][]byte
+}
+
+func mkEk(pass string) (*Ek, error) {
+	k := &Ek{pass: []byte(pass), salt: make([]byte, encSlt), c: make(map[string][]byte)}
+	if _, err := rand.Read(k.salt); err != nil {
+		return nil, err
+	}
+	mk, err := k.master(k.salt)
+	if err != nil {
+		return nil, err
+	}
+	k.mk = mk
+	return k, nil
+}
+
+func (k *Ek) master(salt []byte) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if mk, ok := k.c[string(salt)]; ok {
+		return mk, nil
+	}
+	mk, err := scrypt.Key(k.pass, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	k.c[string(salt)] = mk
+	return mk, nil
+}
+
+// 每个文件一个随机盐，用 HKDF 从主密钥派生文件密钥
+func fileKey(mk, fs []byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, mk, fs, []byte("wdbak v1 file")), key); err != nil {
+		return nil, err
+	}
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+func encNonce(n uint64, last bool) []byte {
+	nc := make([]byte, 12)
+	binary.BigEndian.PutUint64(nc, n)
+	if last {
+		nc[11] = 1
+	}
+	return nc
+}
+
+// 明文 n 字节加密后的大小
+func encSz(n int64) int64 {
+	c := (n + encChk - 1) / encChk
+	if c == 0 {
+		c = 1
+	}
+	return int64(encHdr) + n + int64(encTag)*c
+}
+
+// 远端路径，设置了口令时加后缀
+func encRem(cfg *Cfg, rem string) (string, bool) {
+	if cfg.ek == nil {
+		return rem, false
+	}
+	return rem + encSuf, true
+}
+
+type encR struct {
+	r    io.Reader
+	aead cipher.AEAD
+	hdr  []byte
+	in   []byte
+	k    int // in 里上次多读的字节
+	n    uint64
+	out  []byte
+	done bool
+}
+
+// 边读边加密
+func newEncR(r io.Reader, k *Ek) (io.Reader, error) {
+	fs := make([]byte, encSlt)
+	if _, err := rand.Read(fs); err != nil {
+		return nil, err
+	}
+	aead, err := fileKey(k.mk, fs)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, 0, encHdr)
+	hdr = append(hdr, encMag...)
+	hdr = append(hdr, encVer)
+	hdr = append(hdr, k.salt...)
+	hdr = append(hdr, fs...)
+	return &encR{
+		r:    r,
+		aead: aead,
+		hdr:  hdr,
+		in:   make([]byte, encChk+1),
+		out:  append([]byte(nil), hdr...),
+	}, nil
+}
+
+func (e *encR) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// 多读一个字节判断是不是末块
+func (e *encR) next() error {
+	n, err := io.ReadFull(e.r, e.in[e.k:])
+	n += e.k
+	last := false
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		last = true
+	} else if err != nil {
+		return err
+	}
+	m := n
+	if !last {
+		m = encChk
+	}
+	e.out = e.aead.Seal(e.out[:0], encNonce(e.n, last), e.in[:m], e.hdr)
+	e.n++
+	if last {
+		e.done = true
+	} else {
+		e.in[0] = e.in[encChk]
+		e.k = 1
+	}
+	return nil
+}
+
+type decR struct {
+	r    io.Reader
+	aead cipher.AEAD
+	hdr  []byte
+	in   []byte
+	k    int
+	n    uint64
+	out  []byte
+	done bool
+}
+
+// 边读边解密，认证失败或被截断时返回 errEnc
+func newDecR(r io.Reader, k *Ek) (io.Reader, error) {
+	hdr := make([]byte, encHdr)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", errEnc, err)
+	}
+	if !bytes.Equal(hdr[:len(encMag)], []byte(encMag)) {
+		return nil, fmt.Errorf("%w: magic", errEnc)
+	}
+	if v := hdr[len(encMag)]; v != encVer {
+		return nil, fmt.Errorf("%w: version %d", errEnc, v)
+	}
+	o := len(encMag) + 1
+	mk, err := k.master(hdr[o : o+encSlt])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := fileKey(mk, hdr[o+encSlt:])
+	if err != nil {
+		return nil, err
+	}
+	return &decR{r: r, aead: aead, hdr: hdr, in: make([]byte, encChk+encTag+1)}, nil
+}
+
+func (d *decR) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+func (d *decR) next() error {
+	n, err := io.ReadFull(d.r, d.in[d.k:])
+	n += d.k
+	last := false
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		last = true
+	} else if err != nil {
+		return err
+	}
+	m := n
+	if !last {
+		m = encChk + encTag
+	}
+	out, err := d.aead.Open(d.out[:0], encNonce(d.n, last), d.in[:m], d.hdr)
+	if err != nil {
+		return fmt.Errorf("%w: chunk %d", errEnc, d.n)
+	}
+	d.out = out
+	d.n++
+	if last {
+		d.done = true
+	} else {
+		d.in[0] = d.in[encChk+encTag]
+		d.k = 1
+	}
+	return nil
+}
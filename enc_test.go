@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func encB(t *testing.T, k *Ek, b []byte) []byte {
+	t.Helper()
+	r, err := newEncR(bytes.NewReader(b), k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func decB(k *Ek, c []byte) ([]byte, error) {
+	r, err := newDecR(bytes.NewReader(c), k)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// 块边界前后各差一个字节最容易出错
+func TestEncRoundTrip(t *testing.T) {
+	k, err := mkEk("pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{0, 1, encChk - 1, encChk, encChk + 1, 2 * encChk, 3*encChk + 7} {
+		b := make([]byte, n)
+		rand.Read(b)
+		c := encB(t, k, b)
+		if int64(len(c)) != encSz(int64(n)) {
+			t.Errorf("n=%d: len %d, encSz %d", n, len(c), encSz(int64(n)))
+		}
+		got, err := decB(k, c)
+		if err != nil {
+			t.Errorf("n=%d: %v", n, err)
+			continue
+		}
+		if !bytes.Equal(got, b) {
+			t.Errorf("n=%d: round trip mismatch", n)
+		}
+	}
+}
+
+func TestEncBad(t *testing.T) {
+	k, err := mkEk("pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2*encChk+5)
+	rand.Read(b)
+	c := encB(t, k, b)
+
+	// 去掉末块，剩下的都是完整的块
+	cut := c[:encHdr+2*(encChk+encTag)]
+	if _, err := decB(k, cut); !errors.Is(err, errEnc) {
+		t.Errorf("drop last chunk: %v", err)
+	}
+	// 只剩头
+	if _, err := decB(k, c[:encHdr]); !errors.Is(err, errEnc) {
+		t.Errorf("header only: %v", err)
+	}
+
+	for _, i := range []int{encHdr - 1, encHdr, encHdr + encChk + encTag + 3, len(c) - 1} {
+		x := append([]byte(nil), c...)
+		x[i] ^= 1
+		if _, err := decB(k, x); !errors.Is(err, errEnc) {
+			t.Errorf("flip byte %d: %v", i, err)
+		}
+	}
+
+	w, err := mkEk("wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decB(w, c); !errors.Is(err, errEnc) {
+		t.Errorf("wrong pass: %v", err)
+	}
+}
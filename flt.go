@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// 过滤规则，"re:" 前缀为正则，否则为通配符（支持 **）
+// 不含 / 的通配符只匹配文件名，含 / 的匹配整个相对路径
+type Flt struct {
+	inc []*pat
+	exc []*pat
+	jnk *pat
+	ext map[string]struct{}
+}
+
+type pat struct {
+	re   *regexp.Regexp
+	base bool
+}
+
+// 内置垃圾文件：缩略图缓存、Office 锁文件、临时文件等，只过滤文件不剪目录
+var junk = &pat{
+	re:   regexp.MustCompile(`(?i)^(thumbs\.db|desktop\.ini|~\$.*|.*\.tmp|\.ds_store)$`),
+	base: true,
+}
+
+func mkFlt(c *Cfg) (*Flt, error) {
+	f := &Flt{ext: make(map[string]struct{})}
+	for _, s := range c.Ext {
+		e := normExt(s)
+		if e == "" {
+			continue
+		}
+		if strings.ContainsAny(e, `/\`) {
+			return nil, fmt.Errorf("ext %q: bad", s)
+		}
+		f.ext[e] = struct{}{}
+	}
+	if !c.KeepJunk {
+		f.jnk = junk
+	}
+	for _, s := range c.Inc {
+		p, err := mkPat(s)
+		if err != nil {
+			return nil, fmt.Errorf("inc %q: %w", s, err)
+		}
+		if p != nil {
+			f.inc = append(f.inc, p)
+		}
+	}
+	for _, s := range c.Exc {
+		p, err := mkPat(s)
+		if err != nil {
+			return nil, fmt.Errorf("exc %q: %w", s, err)
+		}
+		if p != nil {
+			f.exc = append(f.exc, p)
+		}
+	}
+	return f, nil
+}
+
+func mkPat(s string) (*pat, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(s, "re:") {
+		re, err := regexp.Compile(s[3:])
+		if err != nil {
+			return nil, err
+		}
+		return &pat{re: re}, nil
+	}
+	s = strings.Trim(strings.ReplaceAll(s, `\`, "/"), "/")
+	re, err := regexp.Compile(glob2re(s))
+	if err != nil {
+		return nil, err
+	}
+	return &pat{re: re, base: !strings.Contains(s, "/")}, nil
+}
+
+// 通配符转正则：** 跨目录，* 和 ? 不跨目录
+func glob2re(g string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(g); i++ {
+		c := g[i]
+		switch c {
+		case '*':
+			if i+1 < len(g) && g[i+1] == '*' {
+				i++
+				if i+1 < len(g) && g[i+1] == '/' {
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			j := strings.IndexByte(g[i+1:], ']')
+			if j < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			cls := g[i+1 : i+1+j]
+			if strings.HasPrefix(cls, "!") {
+				cls = "^" + cls[1:]
+			}
+			b.WriteString("[" + cls + "]")
+			i += j + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+func (p *pat) hit(rel string) bool {
+	if p.base {
+		return p.re.MatchString(path.Base(rel))
+	}
+	return p.re.MatchString(rel)
+}
+
+// 文件是否需要备份，rel 为远端相对路径 (Job.R)
+func (f *Flt) Ok(rel string) bool {
+	if f == nil {
+		return true
+	}
+	if _, ok := f.ext[strings.ToLower(path.Ext(rel))]; ok {
+		return false
+	}
+	if f.jnk != nil && f.jnk.hit(rel) {
+		return false
+	}
+	for _, p := range f.exc {
+		if p.hit(rel) {
+			return false
+		}
+	}
+	if len(f.inc) == 0 {
+		return true
+	}
+	for _, p := range f.inc {
+		if p.hit(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// 目录是否被排除，排除后整个目录不再遍历
+// "a/b/**" 这类规则也能命中目录 a/b 本身
+func (f *Flt) Skp(rel string) bool {
+	if f == nil {
+		return false
+	}
+	for _, p := range f.exc {
+		if p.hit(rel) || (!p.base && p.re.MatchString(rel+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// 上级目录是否被排除，遍历时整个目录被跳过，里面的东西也算被过滤
+func (f *Flt) Up(rel string) bool {
+	for d := path.Dir(rel); d != "." && d != "/"; d = path.Dir(d) {
+		if f.Skp(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// 统一成小写带点的后缀
+func normExt(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.TrimPrefix(s, "*")
+	if s == "" || s == "." {
+		return ""
+	}
+	if !strings.HasPrefix(s, ".") {
+		s = "." + s
+	}
+	return s
+}
@@ -0,0 +1,118 @@
+package main
+
+import "testing"
+
+// 垃圾规则只过滤文件，不剪目录
+func TestFltJunk(t *testing.T) {
+	f, err := mkFlt(&Cfg{Exc: []string{"cache"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := []struct {
+		rel      string
+		ok, skip bool
+	}{
+		{"a/foo.tmp", false, false},
+		{"a/Thumbs.db", false, false},
+		{"a/~$doc.docx", false, false},
+		{"a/doc.docx", true, false},
+		{"a/cache", false, true},
+	}
+	for _, c := range tc {
+		if got := f.Ok(c.rel); got != c.ok {
+			t.Errorf("Ok(%q) = %v, want %v", c.rel, got, c.ok)
+		}
+		if got := f.Skp(c.rel); got != c.skip {
+			t.Errorf("Skp(%q) = %v, want %v", c.rel, got, c.skip)
+		}
+	}
+
+	f, err = mkFlt(&Cfg{KeepJunk: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Ok("a/foo.tmp") {
+		t.Error("keep_junk: foo.tmp filtered")
+	}
+}
+
+func TestGlob2re(t *testing.T) {
+	tc := []struct {
+		g, re string
+	}{
+		{"*.log", `^[^/]*\.log$`},
+		{"a?c", `^a[^/]c$`},
+		{"**/x", `^(?:.*/)?x$`},
+		{"a/**", `^a/.*$`},
+		{"[!x]y", `^[^x]y$`},
+		{"[ab]", `^[ab]$`},
+		{"a[b", `^a\[b$`},
+	}
+	for _, c := range tc {
+		if got := glob2re(c.g); got != c.re {
+			t.Errorf("glob2re(%q) = %q, want %q", c.g, got, c.re)
+		}
+	}
+}
+
+func TestFltOkSkp(t *testing.T) {
+	tc := []struct {
+		exc, inc []string
+		rel      string
+		ok, skip bool
+	}{
+		// Skp 把 rel 当目录看，排除规则命中就剪掉
+		// 不含 / 的只看文件名
+		{exc: []string{"*.log"}, rel: "a/b/x.log", ok: false, skip: true},
+		{exc: []string{"*.log"}, rel: "a/x.txt", ok: true},
+		{exc: []string{"node_modules"}, rel: "p/node_modules", ok: false, skip: true},
+		// 含 / 的匹配整个路径，* 不跨目录
+		{exc: []string{"a/*.txt"}, rel: "a/x.txt", ok: false, skip: true},
+		{exc: []string{"a/*.txt"}, rel: "a/b/x.txt", ok: true},
+		{exc: []string{"/a/*.txt"}, rel: "a/x.txt", ok: false, skip: true},
+		{exc: []string{`a\*.txt`}, rel: "a/x.txt", ok: false, skip: true},
+		// ** 跨目录，**/ 也匹配零层
+		{exc: []string{"a/**/x.txt"}, rel: "a/x.txt", ok: false, skip: true},
+		{exc: []string{"a/**/x.txt"}, rel: "a/b/c/x.txt", ok: false, skip: true},
+		{exc: []string{"a/**/x.txt"}, rel: "b/x.txt", ok: true},
+		{exc: []string{"**/tmp/*"}, rel: "x/tmp/y", ok: false, skip: true},
+		// a/b/** 剪掉目录 a/b 本身，不碰 a/bc
+		{exc: []string{"a/b/**"}, rel: "a/b", ok: true, skip: true},
+		{exc: []string{"a/b/**"}, rel: "a/b/c.txt", ok: false, skip: true},
+		{exc: []string{"a/b/**"}, rel: "a/bc", ok: true},
+		// 字符类
+		{exc: []string{"[!x]y.txt"}, rel: "ay.txt", ok: false, skip: true},
+		{exc: []string{"[!x]y.txt"}, rel: "xy.txt", ok: true},
+		{exc: []string{"[ab].txt"}, rel: "b.txt", ok: false, skip: true},
+		// 没闭合的 [ 按字面
+		{exc: []string{"a[b"}, rel: "a[b", ok: false, skip: true},
+		{exc: []string{"a[b"}, rel: "ab", ok: true},
+		// 正则
+		{exc: []string{`re:^p/cache$`}, rel: "p/cache", ok: false, skip: true},
+		{exc: []string{`re:^p/cache$`}, rel: "q/p/cache", ok: true},
+		// inc 只影响文件，不剪目录
+		{inc: []string{"*.doc"}, rel: "a/x.doc", ok: true},
+		{inc: []string{"*.doc"}, rel: "a/x.txt", ok: false},
+		{inc: []string{"*.doc"}, exc: []string{"tmp"}, rel: "tmp", ok: false, skip: true},
+		{inc: []string{"docs/**"}, rel: "docs", ok: false},
+	}
+	for _, c := range tc {
+		f, err := mkFlt(&Cfg{Exc: c.exc, Inc: c.inc, KeepJunk: true})
+		if err != nil {
+			t.Fatalf("%v %v: %v", c.exc, c.inc, err)
+		}
+		if got := f.Ok(c.rel); got != c.ok {
+			t.Errorf("exc=%v inc=%v Ok(%q) = %v, want %v", c.exc, c.inc, c.rel, got, c.ok)
+		}
+		if got := f.Skp(c.rel); got != c.skip {
+			t.Errorf("exc=%v inc=%v Skp(%q) = %v, want %v", c.exc, c.inc, c.rel, got, c.skip)
+		}
+	}
+
+	if _, err := mkFlt(&Cfg{Exc: []string{"re:("}}); err == nil {
+		t.Error("bad regexp accepted")
+	}
+	if _, err := mkFlt(&Cfg{Ext: []string{"a/b"}}); err == nil {
+		t.Error("bad ext accepted")
+	}
+}
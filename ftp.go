@@ -1,19 +1,47 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
 	"net/url"
-	"os"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	ftp "github.com/jlaffaye/ftp"
 )
 
+// 空闲多久发一次 NOOP，常见服务器空闲超时为 300 秒
+const ftpKa = 60 * time.Second
+
+// 一个 worker 一个控制连接；断线后自动重连并切回登录时的工作目录
+// mu 保护连接，keepalive 与 worker 的操作互斥；cm 保护 ctl/dat，取消时不用等 mu
 type FtpSto struct {
+	mu   sync.Mutex
 	con  *ftp.ServerConn
+	cm   sync.Mutex
+	ctl  net.Conn // 控制连接
+	dat  net.Conn // 最近一次的数据连接
+	h    string
+	usr  string
+	pas  string
+	wd   string // 登录后的工作目录
 	base string
+	bad  bool // 连接已断，下次操作前重连
+	busy bool // Retr 的数据连接还没关，不能发其他命令
+	last time.Time
+	stop chan struct{}
+	nos  map[string]bool // 服务器不支持的校验和命令
+	lim  *Lim
+	meta Sem
 }
 
 func newFtp(cfg *Cfg) (Sto, error) {
@@ -29,30 +57,185 @@ func newFtp(cfg *Cfg) (Sto, error) {
 		h = h + ":21"
 	}
 
-	con, err := ftp.Dial(h, ftp.DialWithTimeout(30*time.Second))
-	if err != nil {
-		return nil, err
-	}
-
 	usr := cfg.User
 	pas := cfg.Pass
 	if usr == "" {
 		usr = "anonymous"
 		pas = "anonymous"
 	}
-	if err := con.Login(usr, pas); err != nil {
-		_ = con.Quit()
+
+	f := &FtpSto{
+		h:    h,
+		usr:  usr,
+		pas:  pas,
+		base: strings.Trim(u.Path, "/"),
+		stop: make(chan struct{}),
+		nos:  make(map[string]bool),
+		lim:  cfg.lim,
+		meta: cfg.meta,
+	}
+	if err := f.dial(context.Background()); err != nil {
 		return nil, err
 	}
+	go f.ka()
+	return f, nil
+}
+
+// 连接并登录，重连时切回原来的工作目录；记下控制和数据连接，取消时给它们设超时
+func (f *FtpSto) dial(ctx context.Context) error {
+	d := net.Dialer{Timeout: 30 * time.Second}
+	ctl := true
+	con, err := ftp.Dial(f.h, ftp.DialWithDialFunc(func(n, a string) (net.Conn, error) {
+		// 数据连接在以后的操作里建立，不能用这次的 ctx
+		dc := context.Background()
+		if ctl {
+			dc = ctx
+		}
+		c, err := d.DialContext(dc, n, a)
+		if err != nil {
+			return nil, err
+		}
+		f.cm.Lock()
+		if ctl {
+			f.ctl = c
+		} else {
+			f.dat = c
+		}
+		f.cm.Unlock()
+		ctl = false
+		return c, nil
+	}))
+	if err != nil {
+		return ftpE("dial", f.h, err)
+	}
+	if err := con.Login(f.usr, f.pas); err != nil {
+		_ = con.Quit()
+		return ftpE("login", f.h, err)
+	}
+	if f.wd == "" {
+		if wd, err := con.CurrentDir(); err == nil {
+			f.wd = wd
+		}
+	} else if err := con.ChangeDir(f.wd); err != nil {
+		_ = con.Quit()
+		return ftpE("cwd", f.wd, err)
+	}
+	f.con, f.bad, f.busy, f.last = con, false, false, time.Now()
+	return nil
+}
+
+// 421 或连接层错误说明控制连接已断
+func ftpDead(err error) bool {
+	var te *textproto.Error
+	if errors.As(err, &te) {
+		return te.Code == ftp.StatusNotAvailable
+	}
+	return netK(err) != nil
+}
+
+func (f *FtpSto) re(ctx context.Context) error {
+	if f.con != nil {
+		_ = f.con.Quit()
+	}
+	if err := f.dial(ctx); err != nil {
+		f.bad = true
+		log.Printf("[WRN] ftp reconnect %s: %v\n", f.h, err)
+		return err
+	}
+	atomic.AddInt64(&stRc, 1)
+	log.Printf("[WRN] ftp reconnected %s\n", f.h)
+	return nil
+}
+
+// 在连接上执行 fn；连接已断时先重连。fn 因断线失败时重连，again 为 true 时再执行一次，
+// 上传的数据已读掉不能重来，交给调用方的 doTry。ctx 取消后不再重连，连接标记为已断
+func (f *FtpSto) do(ctx context.Context, again bool, fn func() error) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stop := f.watch(ctx)
+	defer func() {
+		stop()
+		if ctx.Err() == nil {
+			return
+		}
+		f.bad = true
+		if err != nil && !errors.Is(err, ctx.Err()) {
+			err = fmt.Errorf("%s: %w", strings.TrimSpace(err.Error()), ctx.Err())
+		}
+	}()
+	if f.bad {
+		if err := f.re(ctx); err != nil {
+			return err
+		}
+	}
+	err = fn()
+	f.last = time.Now()
+	if err == nil || !ftpDead(err) || ctx.Err() != nil {
+		return err
+	}
+	dbgLogf("[FTP] %s: connection lost: %v\n", f.h, err)
+	if e := f.re(ctx); e != nil || !again {
+		return err
+	}
+	err = fn()
+	f.last = time.Now()
+	if ftpDead(err) {
+		f.bad = true
+	}
+	return err
+}
 
-	bp := strings.Trim(u.Path, "/")
-	return &FtpSto{
-		con:  con,
-		base: bp,
-	}, nil
+// ctx 取消时把控制和数据连接的超时设为现在，卡在读写上的命令立即返回；调用返回的函数停止监视
+func (f *FtpSto) watch(ctx context.Context) func() {
+	dn := make(chan struct{})
+	go func() {
+		select {
+		case <-dn:
+			return
+		case <-ctx.Done():
+		}
+		f.cm.Lock()
+		for _, c := range []net.Conn{f.ctl, f.dat} {
+			if c != nil {
+				_ = c.SetDeadline(time.Now())
+			}
+		}
+		f.cm.Unlock()
+	}()
+	return func() { close(dn) }
+}
+
+// 空闲时发 NOOP，正在传输或取不到锁时跳过；失败只标记，下次操作时重连
+func (f *FtpSto) ka() {
+	t := time.NewTicker(ftpKa / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-t.C:
+		}
+		if !f.mu.TryLock() {
+			continue
+		}
+		if !f.bad && !f.busy && time.Since(f.last) >= ftpKa {
+			if err := f.con.NoOp(); err != nil {
+				f.bad = true
+				dbgLogf("[FTP] %s: noop: %v\n", f.h, err)
+			}
+			f.last = time.Now()
+		}
+		f.mu.Unlock()
+	}
 }
 
 func (f *FtpSto) Cls() {
+	close(f.stop)
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if f.con != nil {
 		_ = f.con.Quit()
 	}
@@ -69,64 +252,445 @@ func (f *FtpSto) Mk(ctx context.Context, dir string) error {
 	if dir == "" {
 		return nil
 	}
+	if err := f.meta.Get(ctx); err != nil {
+		return err
+	}
+	defer f.meta.Put()
 	p := f.full(dir)
-	if err := f.con.MakeDir(p); err != nil {
-		s := strings.ToLower(err.Error())
-		if strings.Contains(s, "exist") {
+	return f.do(ctx, true, func() error {
+		err := ftpE("mkd", p, f.con.MakeDir(p))
+		if err == nil || errors.Is(err, ErrExists) {
 			return nil
 		}
+		// 多数服务器目录已存在时回 550，能列出就当已存在
+		if errors.Is(err, ErrPermission) {
+			if _, e := f.con.NameList(p); e == nil {
+				return nil
+			}
+		}
 		return err
-	}
-	return nil
+	})
 }
 
 func (f *FtpSto) Has(ctx context.Context, rem string) (bool, error) {
+	if err := f.meta.Get(ctx); err != nil {
+		return false, err
+	}
+	defer f.meta.Put()
+	p := f.full(rem)
+	ok := false
+	err := f.do(ctx, true, func() error {
+		_, err := f.con.FileSize(p)
+		if err == nil {
+			ok = true
+			return nil
+		}
+		if err = ftpE("size", p, err); errors.Is(err, ErrNotFound) {
+			ok = false
+			return nil
+		}
+		return err
+	})
+	return ok, err
+}
+
+func (f *FtpSto) Stat(ctx context.Context, rem string) (*Ent, error) {
+	if err := f.meta.Get(ctx); err != nil {
+		return nil, err
+	}
+	defer f.meta.Put()
 	p := f.full(rem)
-	_, err := f.con.FileSize(p)
-	if err == nil {
+	var out *Ent
+	err := f.do(ctx, true, func() error {
+		out = nil
+		// 支持 MLST 时一次取全，否则用 SIZE + MDTM
+		if f.con.IsTimePreciseInList() {
+			e, err := f.con.GetEntry(p)
+			if err != nil {
+				if err = ftpE("mlst", p, err); errors.Is(err, ErrNotFound) {
+					return nil
+				}
+				return err
+			}
+			out = &Ent{
+				P:   rem,
+				Sz:  int64(e.Size),
+				Mt:  e.Time,
+				Dir: e.Type == ftp.EntryTypeFolder,
+			}
+			return nil
+		}
+		sz, err := f.con.FileSize(p)
+		if err != nil {
+			if err = ftpE("size", p, err); !errors.Is(err, ErrNotFound) {
+				return err
+			}
+			// SIZE 对目录也回 550，能切进去的是目录
+			if ok, err := f.isDir(p); err != nil || !ok {
+				return err
+			}
+			out = &Ent{P: rem, Dir: true}
+			return nil
+		}
+		e := &Ent{P: rem, Sz: sz}
+		if f.con.IsGetTimeSupported() {
+			if mt, err := f.con.GetTime(p); err == nil {
+				e.Mt = mt
+			}
+		}
+		out = e
+		return nil
+	})
+	return out, err
+}
+
+// 切到 p 再切回登录目录；没记下登录目录时标记为已断，下次操作重连回到登录目录
+func (f *FtpSto) isDir(p string) (bool, error) {
+	if p == "" {
 		return true, nil
 	}
-	if isFNF(err) {
-		return false, nil
+	if err := f.con.ChangeDir(p); err != nil {
+		var te *textproto.Error
+		if errors.As(err, &te) {
+			return false, nil
+		}
+		return false, err
+	}
+	if f.wd == "" || f.con.ChangeDir(f.wd) != nil {
+		f.bad = true
 	}
-	return false, err
+	return true, nil
 }
 
-func (f *FtpSto) Put(ctx context.Context, loc, rem string, sz int64) error {
-	p := f.full(rem)
-	dbgLogf("[DBG] PUT %s -> ftp:%s (%d bytes)", loc, p, sz)
-	return doTry(ctx, 3, func() error {
-		fh, err := os.Open(loc)
-		if err != nil {
+func (f *FtpSto) Ls(ctx context.Context, dir string, deep bool) ([]*Ent, error) {
+	// Walk 会在路径后加 /，空路径会变成服务器根目录，登录目录要写成 .
+	root := f.full(dir)
+	if root == "" {
+		root = "."
+	}
+	var out []*Ent
+	err := f.do(ctx, true, func() error {
+		out = nil
+		w := f.con.Walk(root)
+		for w.Next() {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			e := w.Stat()
+			p := strings.Trim(w.Path(), "/")
+			if f.base != "" {
+				p = strings.TrimPrefix(p, f.base+"/")
+			}
+			out = append(out, &Ent{
+				P:   p,
+				Sz:  int64(e.Size),
+				Mt:  e.Time,
+				Dir: e.Type == ftp.EntryTypeFolder,
+			})
+			if !deep {
+				w.SkipDir()
+			}
+		}
+		if err := ftpE("list", root, w.Err()); err != nil && !errors.Is(err, ErrNotFound) {
 			return err
 		}
-		defer fh.Close()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (f *FtpSto) Put(ctx context.Context, src *Src, rem string) error {
+	p := f.full(rem)
+	dbgLogf("[DBG] PUT %s -> ftp:%s (%d bytes)", src.L, p, src.Sz)
+
+	t0 := time.Now()
+	cr := &cntR{r: f.lim.R(ctx, &ctxR{ctx: ctx, r: src.R})}
+	err := f.do(ctx, false, func() error {
+		if err := f.con.Stor(p, cr); err != nil {
+			return ftpE("stor", p, err)
+		}
+		if !src.Mt.IsZero() && f.con.IsSetTimeSupported() {
+			_ = f.con.SetTime(p, src.Mt)
+		}
+		return nil
+	})
+	if err != nil {
+		// 服务器上会留下传了一半的文件，可续传的留着
+		if !src.Rsm && (cr.n > 0 || ctx.Err() != nil) {
+			err = rmPart(f, rem, err)
+		}
+		return err
+	}
+	dur := time.Since(t0).Seconds()
+	if dur <= 0 {
+		dur = 0.001
+	}
+	mb := float64(cr.n) / 1024.0 / 1024.0
+	spd := mb / dur
+	dbgLogf("[OK ] %s -> ftp:%s (%.2f MB, %.1fs, %.2f MB/s)\n",
+		src.L, p, mb, dur, spd)
+	return nil
+}
+
+// 返回的 Response 关闭前不能发其他命令，worker 内串行使用没问题，keepalive 看 busy 让开
+func (f *FtpSto) Get(ctx context.Context, rem string) (io.ReadCloser, error) {
+	var r *ftp.Response
+	err := f.do(ctx, true, func() error {
+		var err error
+		if r, err = f.con.Retr(f.full(rem)); err != nil {
+			return ftpE("retr", f.full(rem), err)
+		}
+		f.busy = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ftpR{ReadCloser: r, f: f, ctx: ctx, stop: f.watch(ctx)}, nil
+}
+
+// 读完前 ctx 取消时连接会被设超时，关闭后标记为已断；可重复关闭，只有第一次生效
+type ftpR struct {
+	io.ReadCloser
+	f    *FtpSto
+	ctx  context.Context
+	stop func()
+	once sync.Once
+	err  error
+}
+
+func (r *ftpR) Close() error {
+	r.once.Do(func() {
+		r.err = r.ReadCloser.Close()
+		r.stop()
+		r.f.mu.Lock()
+		r.f.busy = false
+		r.f.last = time.Now()
+		if (r.err != nil && ftpDead(r.err)) || r.ctx.Err() != nil {
+			r.f.bad = true
+		}
+		r.f.mu.Unlock()
+	})
+	return r.err
+}
 
-		t0 := time.Now()
-		if err := f.con.Stor(p, fh); err != nil {
+func (f *FtpSto) Del(ctx context.Context, rem string, dir bool) error {
+	p := f.full(rem)
+	return f.do(ctx, true, func() error {
+		var err error
+		if dir {
+			err = f.con.RemoveDirRecur(p)
+		} else {
+			err = f.con.Delete(p)
+		}
+		err = ftpE("dele", p, err)
+		if !errors.Is(err, ErrNotFound) {
 			return err
 		}
-		dur := time.Since(t0).Seconds()
-		if dur <= 0 {
-			dur = 0.001
+		// 没权限也回 550，还在就不算删掉
+		in, _ := f.isDir(p)
+		if !dir && !in {
+			_, e := f.con.FileSize(p)
+			in = e == nil
+		}
+		if in {
+			var se *StoE
+			if errors.As(err, &se) {
+				se.K = ErrPermission
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+// 先 REST+STOR，服务器不支持 REST 时改用 APPE
+func (f *FtpSto) PutAt(ctx context.Context, src *Src, rem string, off int64) error {
+	p := f.full(rem)
+	dbgLogf("[DBG] PUT %s -> ftp:%s (%d/%d bytes)", src.L, p, src.Sz-off, src.Sz)
+
+	r := f.lim.R(ctx, &ctxR{ctx: ctx, r: src.R})
+	err := f.do(ctx, false, func() error {
+		err := f.con.StorFrom(p, r, uint64(off))
+		if err != nil && isNI(err) {
+			err = f.con.Append(p, r)
+		}
+		if err != nil {
+			if isNI(err) {
+				return fmt.Errorf("stor %s: %v: %w", p, err, errNoRsm)
+			}
+			return ftpE("stor", p, err)
+		}
+		if !src.Mt.IsZero() && f.con.IsSetTimeSupported() {
+			_ = f.con.SetTime(p, src.Mt)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	e, err := f.Stat(ctx, rem)
+	if err != nil {
+		return err
+	}
+	if e == nil || e.Sz != src.Sz {
+		return fmt.Errorf("stor %s: size mismatch after resume: %w", p, errNoRsm)
+	}
+	dbgLogf("[OK ] %s -> ftp:%s (resumed @%d)\n", src.L, p, off)
+	return nil
+}
+
+// 先用 HASH（draft-bryan-ftpext-hash，OPTS HASH 选算法），不支持时用 XSHA1/XMD5；
+// 都不支持时返回 errNoSum，不支持的命令记下来以后不再发
+func (f *FtpSto) Sum(ctx context.Context, rem string) (map[string]string, error) {
+	p := f.full(rem)
+	m := make(map[string]string)
+	err := f.do(ctx, true, func() error {
+		if !f.nos["HASH"] {
+			for _, alg := range []string{"SHA-1", "MD5"} {
+				c, _, err := f.raw("OPTS HASH " + alg)
+				if err != nil {
+					return err
+				}
+				if noCmd(c) {
+					f.nos["HASH"] = true
+					break
+				}
+				if c/100 != 2 {
+					continue
+				}
+				c, msg, err := f.raw("HASH " + p)
+				if err != nil {
+					return err
+				}
+				switch {
+				case c == ftp.StatusFile:
+					// 213 SHA-1 0-49 <hash> <path>
+					if fs := strings.Fields(msg); len(fs) >= 3 {
+						m[strings.ToLower(strings.ReplaceAll(fs[0], "-", ""))] = strings.ToLower(fs[2])
+						return nil
+					}
+					return fmt.Errorf("hash %s: bad reply %q", p, msg)
+				case noCmd(c):
+					f.nos["HASH"] = true
+				default:
+					return ftpE("hash", p, &textproto.Error{Code: c, Msg: msg})
+				}
+				break
+			}
+		}
+		for _, x := range []struct{ cmd, alg string }{{"XSHA1", "sha1"}, {"XMD5", "md5"}} {
+			if f.nos[x.cmd] {
+				continue
+			}
+			c, msg, err := f.raw(x.cmd + " " + p)
+			if err != nil {
+				return err
+			}
+			switch {
+			case c/100 == 2:
+				// 250 <hash>，有的服务器后面还带路径
+				if fs := strings.Fields(msg); len(fs) > 0 {
+					m[x.alg] = strings.ToLower(fs[0])
+					return nil
+				}
+				return fmt.Errorf("%s %s: bad reply %q", strings.ToLower(x.cmd), p, msg)
+			case noCmd(c):
+				f.nos[x.cmd] = true
+			default:
+				return ftpE(strings.ToLower(x.cmd), p, &textproto.Error{Code: c, Msg: msg})
+			}
 		}
-		mb := float64(sz) / 1024.0 / 1024.0
-		spd := mb / dur
-		dbgLogf("[OK ] %s -> ftp:%s (%.2f MB, %.1fs, %.2f MB/s)\n",
-			loc, p, mb, dur, spd)
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	if len(m) == 0 {
+		return nil, errNoSum
+	}
+	return m, nil
+}
+
+// jlaffaye/ftp 没有发任意命令的接口，直接在控制连接上收发。调用方持有 mu，
+// 上一条命令的应答已读完，连接上没有多余数据
+func (f *FtpSto) raw(cmd string) (int, string, error) {
+	f.cm.Lock()
+	c := f.ctl
+	f.cm.Unlock()
+	if c == nil {
+		return 0, "", errors.New("ftp: not connected")
+	}
+	if _, err := fmt.Fprintf(c, "%s\r\n", cmd); err != nil {
+		return 0, "", err
+	}
+	code, msg, err := textproto.NewReader(bufio.NewReader(c)).ReadResponse(0)
+	if err != nil {
+		return 0, "", err
+	}
+	if code == ftp.StatusNotAvailable {
+		return 0, "", &textproto.Error{Code: code, Msg: msg}
+	}
+	return code, msg, nil
 }
 
-func isFNF(err error) bool {
-	if err == nil {
+// 500/502/504 为命令或参数不支持
+func noCmd(c int) bool {
+	return c == ftp.StatusBadCommand || c == ftp.StatusNotImplemented ||
+		c == ftp.StatusNotImplementedParameter
+}
+
+// 命令未实现
+func isNI(err error) bool {
+	var te *textproto.Error
+	if !errors.As(err, &te) {
 		return false
 	}
-	s := strings.ToLower(err.Error())
-	if strings.Contains(s, "550") ||
-		strings.Contains(s, "not found") ||
-		strings.Contains(s, "no such file") {
+	switch te.Code {
+	case ftp.StatusBadCommand, ftp.StatusBadArguments,
+		ftp.StatusNotImplemented, ftp.StatusNotImplementedParameter:
 		return true
 	}
 	return false
 }
+
+// 按应答码分类，不是 FTP 应答的错误原样返回
+func ftpE(op, p string, err error) error {
+	var te *textproto.Error
+	if err == nil || !errors.As(err, &te) {
+		return err
+	}
+	var k error
+	switch c := te.Code; {
+	case c == ftp.StatusNotLoggedIn || c == ftp.StatusInvalidCredentials ||
+		c == ftp.StatusStorNeedAccount:
+		k = ErrAuth
+	case c == ftp.StatusFileUnavailable:
+		k = f550(op)
+	case c == ftp.Status452 || c == ftp.StatusExceededStorage:
+		k = ErrQuota
+	case c == ftp.StatusBadFileName:
+		k = ErrPermission
+	case c == 521:
+		k = ErrExists
+	case c >= 400 && c < 500:
+		k = ErrTransient
+	}
+	return &StoE{Op: op, P: p, K: k, Err: err}
+}
+
+// 550 既表示不存在也表示无权限，提示文字因服务器和语言而异，只按命令分：
+// 读、删、列的当作不存在，写的当作无权限；删除时调用方再确认一下文件是不是还在
+func f550(op string) error {
+	switch op {
+	case "stor", "mkd":
+		return ErrPermission
+	case "size", "mlst", "retr", "dele", "list", "cwd", "hash":
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestFtpE(t *testing.T) {
+	tc := []struct {
+		op   string
+		code int
+		msg  string
+		k    error
+		no   bool
+	}{
+		{"login", 530, "Login incorrect.", ErrAuth, true},
+		{"stor", 421, "Timeout.", ErrTransient, false},
+		{"stor", 450, "File busy.", ErrTransient, false},
+		{"stor", 452, "Insufficient storage.", ErrQuota, true},
+		{"stor", 552, "Exceeded storage allocation.", ErrQuota, true},
+		{"stor", 553, "Bad file name.", ErrPermission, true},
+		{"size", 550, "/a: No such file or directory", ErrNotFound, true},
+		{"size", 550, "Could not get file size.", ErrNotFound, true},
+		{"size", 550, "Permission denied.", ErrNotFound, true},
+		{"mlst", 550, "Datei nicht gefunden.", ErrNotFound, true},
+		{"retr", 550, "Failed to open file.", ErrNotFound, true},
+		{"list", 550, "No such directory.", ErrNotFound, true},
+		{"cwd", 550, "Failed to change directory.", ErrNotFound, true},
+		{"stor", 550, "Permission denied.", ErrPermission, true},
+		{"stor", 550, "Can't open file.", ErrPermission, true},
+		{"stor", 550, "/a: No such file or directory", ErrPermission, true},
+		{"dele", 550, "Delete operation failed.", ErrNotFound, true},
+		{"dele", 550, "/a: No such file or directory", ErrNotFound, true},
+		{"mkd", 550, "Create directory operation failed.", ErrPermission, true},
+		{"login", 550, "x", nil, true},
+		{"mkd", 521, "Directory exists.", ErrExists, true},
+	}
+	for _, c := range tc {
+		err := ftpE(c.op, "a", &textproto.Error{Code: c.code, Msg: c.msg})
+		var se *StoE
+		if !errors.As(err, &se) {
+			t.Fatalf("%s %d: %v is not *StoE", c.op, c.code, err)
+		}
+		if se.K != c.k {
+			t.Errorf("%s %d %q: kind %v, want %v", c.op, c.code, c.msg, se.K, c.k)
+		}
+		if got := noTry(err); got != c.no {
+			t.Errorf("%s %d %q: noTry %v, want %v", c.op, c.code, c.msg, got, c.no)
+		}
+	}
+
+	// 不是 FTP 应答的错误原样返回
+	e := errors.New("x")
+	if ftpE("stor", "a", e) != e || ftpE("stor", "a", nil) != nil {
+		t.Error("non-reply error changed")
+	}
+}
+
+type cntC struct {
+	io.Reader
+	n int
+}
+
+func (c *cntC) Close() error {
+	c.n++
+	return nil
+}
+
+// 重复关闭不能 panic，底层只关一次
+func TestFtpRClose(t *testing.T) {
+	f := &FtpSto{busy: true}
+	ctx := context.Background()
+	c := &cntC{Reader: strings.NewReader("x")}
+	r := &ftpR{ReadCloser: c, f: f, ctx: ctx, stop: f.watch(ctx)}
+	for i := 0; i < 2; i++ {
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.n != 1 || f.busy || f.bad {
+		t.Errorf("n=%d busy=%v bad=%v", c.n, f.busy, f.bad)
+	}
+}
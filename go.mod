@@ -2,11 +2,14 @@ module WDBak
 
 go 1.20
 
+require (
+	github.com/hirochachacha/go-smb2 v1.1.0
+	github.com/jlaffaye/ftp v0.2.0
+	golang.org/x/crypto v0.0.0-20200728195943-123391ffb6de
+)
+
 require (
 	github.com/geoffgarside/ber v1.1.0 // indirect
 	github.com/hashicorp/errwrap v1.0.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
-	github.com/hirochachacha/go-smb2 v1.1.0 // indirect
-	github.com/jlaffaye/ftp v0.2.0 // indirect
-	golang.org/x/crypto v0.0.0-20200728195943-123391ffb6de // indirect
 )
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// 日志文件默认大小上限（MB）和保留的旧文件数
+const (
+	defLogMax  = 10
+	defLogKeep = 5
+)
+
+// 所有日志经过这里：按级别过滤，自己加时间戳，写控制台和日志文件
+type lgW struct {
+	mu  sync.Mutex
+	lv  int
+	con io.Writer // nil 时不写控制台
+	f   *rotF
+}
+
+var lgw = &lgW{lv: lvInf, con: os.Stderr}
+
+func (w *lgW) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if msgLv(b) > w.lv {
+		return len(b), nil
+	}
+	ln := append([]byte(time.Now().Format("2006/01/02 15:04:05.000000 ")), b...)
+	if w.con != nil {
+		w.con.Write(ln)
+	}
+	if w.f != nil {
+		if err := w.f.Write(ln); err != nil && w.con != nil {
+			fmt.Fprintf(w.con, "[ERR] log file: %v\n", err)
+		}
+	}
+	return len(b), nil
+}
+
+// dbgLogf 在调用处已过滤，这里只区分错误和警告
+func msgLv(b []byte) int {
+	switch {
+	case bytes.HasPrefix(b, []byte("[ERR]")):
+		return lvErr
+	case bytes.HasPrefix(b, []byte("[WRN]")):
+		return lvWrn
+	}
+	return lvInf
+}
+
+// 进度行要接管控制台时替换
+func (w *lgW) setCon(c io.Writer) {
+	w.mu.Lock()
+	w.con = c
+	w.mu.Unlock()
+}
+
+// 打开日志文件；非交互运行时只写文件，交互运行时控制台照常输出
+func (w *lgW) open(p string, max, keep int) error {
+	if max <= 0 {
+		max = defLogMax
+	}
+	if keep <= 0 {
+		keep = defLogKeep
+	}
+	f := &rotF{p: p, max: int64(max) << 20, keep: keep}
+	if err := f.open(); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.f = f
+	if !ttyErr() {
+		w.con = nil
+	}
+	w.mu.Unlock()
+	return nil
+}
+
+func (w *lgW) Cls() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f != nil {
+		w.f.f.Close()
+		w.f = nil
+	}
+}
+
+// 按大小轮转：p 写满后依次改名为 p.1 ... p.keep，最旧的删掉
+type rotF struct {
+	p    string
+	max  int64
+	keep int
+	f    *os.File
+	n    int64
+}
+
+func (r *rotF) open() error {
+	f, err := os.OpenFile(r.p, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.n = f, st.Size()
+	return nil
+}
+
+func (r *rotF) Write(b []byte) error {
+	if r.n > 0 && r.n+int64(len(b)) > r.max {
+		if err := r.rot(); err != nil {
+			return err
+		}
+	}
+	n, err := r.f.Write(b)
+	r.n += int64(n)
+	return err
+}
+
+func (r *rotF) rot() error {
+	r.f.Close()
+	os.Remove(fmt.Sprintf("%s.%d", r.p, r.keep))
+	for i := r.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.p, i), fmt.Sprintf("%s.%d", r.p, i+1))
+	}
+	err := os.Rename(r.p, r.p+".1")
+	// 改名失败也要重新打开，继续写原文件
+	if e := r.open(); e != nil {
+		return e
+	}
+	return err
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Windows 快捷方式 (.lnk, MS-SHLLINK) 解析，只取目标路径，不依赖系统 API
+
+var lnkCLSID = []byte{
+	0x01, 0x14, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xc0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x46,
+}
+
+const (
+	lnkHasIDList  = 1 << 0
+	lnkHasInfo    = 1 << 1
+	lnkHasName    = 1 << 2
+	lnkHasRelPath = 1 << 3
+	lnkUnicode    = 1 << 7
+
+	lnkVolLocal = 1 << 0
+	lnkNet      = 1 << 1
+)
+
+var errLnk = errors.New("bad lnk")
+
+func isLnk(p string) bool {
+	return strings.EqualFold(filepath.Ext(p), ".lnk")
+}
+
+// 读取快捷方式目标，相对路径按快捷方式所在目录解析
+func rdLnk(p string) (string, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return "", err
+	}
+	t, rel, err := prsLnk(b)
+	if err != nil {
+		return "", err
+	}
+	if t != "" {
+		return t, nil
+	}
+	if rel == "" {
+		return "", errors.New("lnk has no target")
+	}
+	rel = strings.ReplaceAll(rel, `\`, "/")
+	return filepath.Join(filepath.Dir(p), filepath.FromSlash(rel)), nil
+}
+
+// 返回 LinkInfo 里的绝对路径，没有时返回 StringData 里的相对路径
+func prsLnk(b []byte) (tgt, rel string, err error) {
+	if len(b) < 0x4c || le32(b, 0) != 0x4c || !bytes.Equal(b[4:20], lnkCLSID) {
+		return "", "", errLnk
+	}
+	flg := le32(b, 20)
+	off := 0x4c
+
+	if flg&lnkHasIDList != 0 {
+		if off+2 > len(b) {
+			return "", "", errLnk
+		}
+		off += 2 + int(le16(b, off))
+	}
+
+	if flg&lnkHasInfo != 0 {
+		if off+4 > len(b) {
+			return "", "", errLnk
+		}
+		n := int(le32(b, off))
+		if n < 0x1c || off+n > len(b) {
+			return "", "", errLnk
+		}
+		tgt = lnkInfo(b[off : off+n])
+		off += n
+	}
+
+	// StringData 依次为 NAME、RELATIVE_PATH、WORKING_DIR...
+	uni := flg&lnkUnicode != 0
+	if flg&lnkHasName != 0 {
+		_, off = lnkStr(b, off, uni)
+	}
+	if flg&lnkHasRelPath != 0 && off >= 0 {
+		rel, _ = lnkStr(b, off, uni)
+	}
+	return tgt, rel, nil
+}
+
+func lnkInfo(li []byte) string {
+	hs := le32(li, 4)
+	flg := le32(li, 8)
+	var base, suf string
+	if hs >= 0x24 && len(li) >= 0x24 {
+		base = u16z(li, int(le32(li, 0x1c)))
+		suf = u16z(li, int(le32(li, 0x20)))
+	}
+	if base == "" && flg&lnkVolLocal != 0 {
+		base = az(li, int(le32(li, 0x10)))
+	}
+	if suf == "" {
+		suf = az(li, int(le32(li, 0x18)))
+	}
+	if base == "" && flg&lnkNet != 0 {
+		// CommonNetworkRelativeLink 里的 NetName，如 \\srv\share
+		o := int(le32(li, 0x14))
+		if o > 0 && o+0x14 <= len(li) {
+			nl := li[o:]
+			no := int(le32(nl, 8))
+			if no > 0x14 && len(nl) >= 0x1c {
+				base = u16z(nl, int(le32(nl, 0x14)))
+			}
+			if base == "" {
+				base = az(nl, no)
+			}
+		}
+	}
+	if base == "" {
+		return ""
+	}
+	if suf == "" {
+		return base
+	}
+	if !strings.HasSuffix(base, `\`) {
+		base += `\`
+	}
+	return base + suf
+}
+
+// StringData 项：2 字节字符数 + 内容，返回内容和下一项偏移，越界时偏移为 -1
+func lnkStr(b []byte, off int, uni bool) (string, int) {
+	if off < 0 || off+2 > len(b) {
+		return "", -1
+	}
+	n := int(le16(b, off))
+	off += 2
+	if uni {
+		n *= 2
+	}
+	if off+n > len(b) {
+		return "", -1
+	}
+	s := b[off : off+n]
+	if uni {
+		return dec16(s), off + n
+	}
+	return ansi(s), off + n
+}
+
+func le16(b []byte, o int) uint16 {
+	if o < 0 || o+2 > len(b) {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b[o:])
+}
+
+func le32(b []byte, o int) uint32 {
+	if o < 0 || o+4 > len(b) {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b[o:])
+}
+
+// 以 0 结尾的 ANSI 串
+func az(b []byte, o int) string {
+	if o <= 0 || o >= len(b) {
+		return ""
+	}
+	s := b[o:]
+	if i := bytes.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return ansi(s)
+}
+
+// 以 0 结尾的 UTF-16LE 串
+func u16z(b []byte, o int) string {
+	if o <= 0 || o >= len(b) {
+		return ""
+	}
+	s := b[o:]
+	for i := 0; i+1 < len(s); i += 2 {
+		if s[i] == 0 && s[i+1] == 0 {
+			return dec16(s[:i])
+		}
+	}
+	return ""
+}
+
+func dec16(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
+
+// 系统代码页无法确定，合法 UTF-8 原样用，否则按 Latin-1
+func ansi(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+// 目标路径的文件名，兼容 \ 和 /
+func lnkBase(t string) string {
+	t = strings.TrimRight(t, `\/`)
+	if i := strings.LastIndexAny(t, `\/`); i >= 0 {
+		return t[i+1:]
+	}
+	return t
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrsLnk(t *testing.T) {
+	tc := []struct {
+		f   string
+		tgt string
+		rel string
+		err bool
+	}{
+		{f: "local.lnk", tgt: `C:\Windows\notepad.exe`},
+		{f: "rel.lnk", rel: `..\docs\a.txt`},
+		{f: "uni.lnk", tgt: `C:\文档\报告.docx`, rel: `..\文档\报告.docx`},
+		{f: "unc.lnk", tgt: `\\srv\share\docs\a.txt`},
+		{f: "trunc.lnk", err: true},
+		{f: "bad.lnk", err: true},
+	}
+	for _, c := range tc {
+		b, err := os.ReadFile(filepath.Join("testdata", c.f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tgt, rel, err := prsLnk(b)
+		if c.err {
+			if !errors.Is(err, errLnk) {
+				t.Errorf("%s: err = %v, want errLnk", c.f, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.f, err)
+			continue
+		}
+		if tgt != c.tgt || rel != c.rel {
+			t.Errorf("%s: got %q %q, want %q %q", c.f, tgt, rel, c.tgt, c.rel)
+		}
+	}
+}
+
+// 相对路径按快捷方式所在目录解析
+func TestRdLnkRel(t *testing.T) {
+	p := filepath.Join("testdata", "rel.lnk")
+	got, err := rdLnk(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join("docs", "a.txt"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// 任意截断都不能 panic
+func TestPrsLnkTrunc(t *testing.T) {
+	for _, f := range []string{"local.lnk", "uni.lnk", "unc.lnk"} {
+		b, err := os.ReadFile(filepath.Join("testdata", f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := 0; n < len(b); n++ {
+			_, _, err := prsLnk(b[:n])
+			if n < 0x4c && err == nil {
+				t.Errorf("%s[:%d]: want error", f, n)
+			}
+		}
+	}
+}
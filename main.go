@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"os"
@@ -13,11 +16,13 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type Job struct {
-	L string
-	R string
+	L  string
+	R  string
+	Mt time.Time // 远端修改时间，恢复时用
 }
 
 type DirC struct {
@@ -25,13 +30,32 @@ type DirC struct {
 	set map[string]struct{}
 }
 
+// 一次运行中各 worker 共享的状态，未开启的功能为 nil
+type Rs struct {
+	dc  *DirC
+	db  *Db
+	pj  *Pj
+	mir *Mir
+	sl  *SymL
+	pk  *Pk
+	prg *Prg
+	rp  *Rpt
+}
+
 var stTot int64
 var stSkp int64
 var stOk int64
 var stErr int64
+var stFlt int64
+var stDel int64
+var stByt int64
+var stLnk int64
+var stRc int64 // FTP/SMB 断线重连次数
 
 func main() {
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	// 时间戳由 lgw 加
+	log.SetFlags(0)
+	log.SetOutput(lgw)
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
@@ -39,13 +63,15 @@ func main() {
 		if ctx.Err() != nil {
 			log.Printf("stop: %v\n", ctx.Err())
 		} else {
-			log.Printf("err: %v\n", err)
+			log.Printf("[ERR] %v\n", err)
 		}
+		lgw.Cls()
 		os.Exit(1)
 	}
+	lgw.Cls()
 }
 
-func run(ctx context.Context) error {
+func run(ctx context.Context) (err error) {
 	exe, err := os.Executable()
 	if err != nil {
 		return err
@@ -58,7 +84,19 @@ func run(ctx context.Context) error {
 		return err
 	}
 
-	setDbg(cfg.Debug)
+	if err := setLv(cfg.LogLv, cfg.Debug); err != nil {
+		return err
+	}
+	setTry(cfg.Retry)
+	if cfg.Log != "" {
+		p := cfg.Log
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+		if err := lgw.open(p, cfg.LogMax, cfg.LogKeep); err != nil {
+			return fmt.Errorf("log %s: %w", p, err)
+		}
+	}
 
 	if cfg.Thr <= 0 {
 		cfg.Thr = runtime.NumCPU()
@@ -66,35 +104,107 @@ func run(ctx context.Context) error {
 			cfg.Thr = 1
 		}
 	}
+	apCon(cfg)
 
-	log.Printf("thr=%d mode=%s\n", cfg.Thr, cfg.Mode)
+	fg := flag.NewFlagSet("WDBak", flag.ContinueOnError)
+	dry := fg.Bool("n", false, "dry run, print the plan without touching the server")
+	fg.BoolVar(dry, "dry-run", false, "same as -n")
+	if err := fg.Parse(os.Args[1:]); err != nil {
+		return err
+	}
+	if *dry {
+		cfg.Dry = true
+	}
 
-	dc := &DirC{set: make(map[string]struct{})}
-	q := make(chan Job, cfg.Thr*4)
-	var wg sync.WaitGroup
+	if fg.NArg() > 0 {
+		switch fg.Arg(0) {
+		case "rebuild":
+			return rebuild(ctx, cfg, dir)
+		case "restore":
+			return restore(ctx, cfg, fg.Args()[1:])
+		default:
+			return fmt.Errorf("unknown cmd: %s", fg.Arg(0))
+		}
+	}
 
-	for i := 0; i < cfg.Thr; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			sto, err := mkSto(cfg)
-			if err != nil {
-				log.Printf("[ERR] mkSto: %v\n", err)
+	// 报告里的配置指纹按快照改 root 之前的取
+	rp := mkRpt(cfg)
+	rs := &Rs{dc: &DirC{set: make(map[string]struct{})}, rp: rp}
+	// 打开状态库、检查源等提前失败时也写报告
+	defer func() { rs.rp.Done(ctx, cfg, rs, dir, err) }()
+
+	// 快照每次写到新目录，不需要比对远端和状态库
+	base, cur := cfg.Root, ""
+	if cfg.Snap {
+		if cur, err = snapUniq(ctx, cfg, base, snapName(cfg, time.Now())); err != nil {
+			return fmt.Errorf("snap: %w", err)
+		}
+		cfg.Root = path.Join(base, cur)
+		cfg.Mode = "over"
+		if cfg.State {
+			log.Printf("[WRN] state ignored in snapshot mode\n")
+		}
+		// 每次都是新目录，没有可续传的半截文件，续传日志也会按快照路径一次一个
+		if cfg.Resume > 0 {
+			log.Printf("[WRN] resume ignored in snapshot mode\n")
+		}
+		log.Printf("snap=%s\n", cfg.Root)
+	}
+
+	log.Printf("thr=%d mode=%s sym=%s dry=%v\n", cfg.Thr, cfg.Mode, cfg.Sym, cfg.Dry)
+
+	// newer/mirror 要记上传后的远端时间，没开 state 也用状态库，只是不按它跳过
+	if (cfg.State || cfg.Mode == "newer" || cfg.Mode == "mirror") && !cfg.Snap {
+		rs.db, err = opDb(keyP(dir, cfg, ".db"))
+		if err != nil {
+			return fmt.Errorf("state: %w", err)
+		}
+		stop := func() {}
+		if !cfg.Dry {
+			stop = rs.db.auto()
+		}
+		defer func() {
+			if cfg.Dry {
 				return
 			}
-			defer sto.Cls()
-			for j := range q {
-				if ctx.Err() != nil {
-					return
-				}
-				if err := upOne(ctx, sto, cfg, j, dc); err != nil {
-					atomic.AddInt64(&stErr, 1)
-					log.Printf("[ERR] %v\n", err)
-				}
+			stop()
+			if err := rs.db.Save(); err != nil {
+				log.Printf("[ERR] state save: %v\n", err)
 			}
 		}()
 	}
+	if cfg.Resume > 0 && !cfg.Snap {
+		rs.pj, err = opPj(keyP(dir, cfg, ".part"))
+		if err != nil {
+			return fmt.Errorf("resume: %w", err)
+		}
+	}
+	if cfg.Pack > 0 {
+		rs.pk, err = opPk(ctx, cfg)
+		if err != nil {
+			return fmt.Errorf("pack: %w", err)
+		}
+	}
+	if cfg.Mode == "mirror" {
+		// 源目录缺失或为空时拒绝运行，免得把远端删光
+		if err := ckSrc(cfg, dir); err != nil {
+			return fmt.Errorf("mirror: %w", err)
+		}
+		rs.mir = &Mir{set: make(map[string]struct{})}
+	}
+	if cfg.Sym == "record" {
+		rs.sl = &SymL{m: make(map[string]string)}
+	}
+
+	rs.prg = mkPrg(cfg)
+	rs.prg.Run(ctx, cfg, dir)
+
+	q := make(chan Job, cfg.Thr*4)
+	wg := pool(ctx, cfg, q, func(sto Sto, j Job) error {
+		return upOne(ctx, sto, cfg, j, rs)
+	})
 
+	addOk, mirOk := true, true
 	for _, s := range cfg.List {
 		if ctx.Err() != nil {
 			break
@@ -102,77 +212,274 @@ func run(ctx context.Context) error {
 		if !filepath.IsAbs(s) {
 			s = filepath.Join(dir, s)
 		}
-		if err := addJob(ctx, s, q); err != nil {
+		n, err := addJob(ctx, cfg, s, q, rs.sl)
+		if err != nil {
+			addOk = false
 			log.Printf("[ERR] add %s: %v\n", s, err)
+			rs.rp.Msg(fmt.Sprintf("add %s: %v", s, err))
+		} else if rs.mir != nil && n == 0 && ctx.Err() == nil {
+			// 只剩垃圾文件或全被过滤的源等同于空目录
+			mirOk = false
+			atomic.AddInt64(&stErr, 1)
+			log.Printf("[ERR] mirror: src %s has no files to back up\n", s)
+			rs.rp.Msg(fmt.Sprintf("mirror: src %s has no files to back up", s))
 		}
 	}
 
 	close(q)
 	wg.Wait()
+	rs.pk.Done(ctx, cfg, rs)
+	rs.prg.Stop()
+
+	if rs.sl != nil && ctx.Err() == nil {
+		// 清单不完整时不覆盖远端的旧清单
+		if !addOk {
+			log.Printf("[ERR] sym: walk failed, skip links manifest\n")
+		} else if err := putSym(ctx, cfg, rs); err != nil {
+			atomic.AddInt64(&stErr, 1)
+			log.Printf("[ERR] sym: %v\n", err)
+			rs.rp.Msg("sym: " + err.Error())
+		}
+	}
+
+	// 清理被取代的打包卷；镜像时在 mirror 里连同本地已删除的一起清理
+	if rs.pk != nil && ctx.Err() == nil && (rs.mir == nil || !addOk || !mirOk) {
+		if err := rs.pk.gc(ctx, nil, cfg, rs, nil); err != nil {
+			atomic.AddInt64(&stErr, 1)
+			log.Printf("[ERR] pack gc: %v\n", err)
+			rs.rp.Msg("pack gc: " + err.Error())
+		}
+	}
+
+	if rs.mir != nil && ctx.Err() == nil {
+		// 本地列表不完整时不删，避免误删
+		if !addOk {
+			log.Printf("[ERR] mirror: walk failed, skip delete\n")
+		} else if !mirOk {
+			log.Printf("[ERR] mirror: empty source, skip delete\n")
+		} else if err := mirror(ctx, cfg, rs); err != nil {
+			atomic.AddInt64(&stErr, 1)
+			log.Printf("[ERR] mirror: %v\n", err)
+			rs.rp.Msg("mirror: " + err.Error())
+		}
+	}
+
+	if cfg.Snap && ctx.Err() == nil {
+		// 本次快照不完整时不清理旧快照
+		if !addOk || atomic.LoadInt64(&stErr) > 0 {
+			log.Printf("[WRN] snapshot has errors, skip prune\n")
+		} else if err := prune(ctx, cfg, base, cur); err != nil {
+			atomic.AddInt64(&stErr, 1)
+			log.Printf("[ERR] prune: %v\n", err)
+			rs.rp.Msg("prune: " + err.Error())
+		}
+	}
 
-	log.Printf("tot=%d ok=%d skip=%d err=%d\n",
+	pre := ""
+	if cfg.Dry {
+		pre = "[PLAN] "
+	}
+	log.Printf("%stot=%d ok=%d skip=%d flt=%d del=%d err=%d bytes=%d sym=%s:%d\n",
+		pre,
 		atomic.LoadInt64(&stTot),
 		atomic.LoadInt64(&stOk),
 		atomic.LoadInt64(&stSkp),
+		atomic.LoadInt64(&stFlt),
+		atomic.LoadInt64(&stDel),
 		atomic.LoadInt64(&stErr),
+		atomic.LoadInt64(&stByt),
+		cfg.Sym,
+		atomic.LoadInt64(&stLnk),
 	)
+	if s := kSum(); s != "" {
+		log.Printf("%serr by kind: %s\n", pre, s)
+	}
+	if n := atomic.LoadInt64(&stRc); n > 0 {
+		log.Printf("%sreconnects=%d\n", pre, n)
+	}
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
 	return nil
 }
 
-func addJob(ctx context.Context, src string, q chan<- Job) error {
+// 起 cfg.Thr 个 worker，每个 worker 一个连接，出错只计数不中断
+func pool(ctx context.Context, cfg *Cfg, q <-chan Job, fn func(sto Sto, j Job) error) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Thr; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sto, err := mkSto(cfg)
+			if err != nil {
+				log.Printf("[ERR] mkSto: %v\n", err)
+				return
+			}
+			defer sto.Cls()
+			for j := range q {
+				if ctx.Err() != nil {
+					return
+				}
+				if err := fn(sto, j); err != nil {
+					atomic.AddInt64(&stErr, 1)
+					addK(err)
+					log.Printf("[ERR] %v\n", err)
+				}
+			}
+		}()
+	}
+	return &wg
+}
+
+// 遍历一个源，返回放进队列的文件数
+func addJob(ctx context.Context, cfg *Cfg, src string, q chan<- Job, sl *SymL) (int, error) {
 	if ctx.Err() != nil {
-		return ctx.Err()
+		return 0, ctx.Err()
 	}
 	src = filepath.Clean(src)
 	st, err := os.Stat(src)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	w := &wk{ctx: ctx, cfg: cfg, q: q, sl: sl, seen: make(map[string]bool)}
 	if st.IsDir() {
-		base := filepath.Base(src)
-		return filepath.WalkDir(src, func(p string, d fs.DirEntry, e error) error {
-			if e != nil {
-				return e
-			}
-			if d.IsDir() {
-				return nil
-			}
-			info, e := d.Info()
-			if e != nil {
-				return nil
-			}
-			if !info.Mode().IsRegular() {
-				return nil
-			}
-			if ctx.Err() != nil {
-				return ctx.Err()
-			}
-			rel, e := filepath.Rel(src, p)
-			if e != nil {
-				return e
-			}
-			rel = filepath.ToSlash(rel)
-			rp := base
-			if rel != "." {
-				rp = path.Join(base, rel)
+		err = w.walk(src, filepath.Base(src), 0)
+		return w.n, err
+	}
+	if !st.Mode().IsRegular() {
+		return 0, nil
+	}
+	w.file(src, filepath.Base(src), 0)
+	return w.n, nil
+}
+
+// 跟随快捷方式和符号链接的最大层数
+const maxDep = 8
+
+// 遍历一个源，seen 记录已遍历过的目录防止循环
+type wk struct {
+	ctx  context.Context
+	cfg  *Cfg
+	q    chan<- Job
+	sl   *SymL
+	seen map[string]bool
+	n    int // 已放进队列的文件数
+}
+
+// 遍历目录 src，远端路径以 base 开头
+func (w *wk) walk(src, base string, dep int) error {
+	// WalkDir 不跟随根上的符号链接，先解析成真实路径
+	if t, err := filepath.EvalSymlinks(src); err == nil {
+		src = t
+	}
+	w.seen[src] = true
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, e error) error {
+		if e != nil {
+			return e
+		}
+		if w.ctx.Err() != nil {
+			return w.ctx.Err()
+		}
+		rel, e := filepath.Rel(src, p)
+		if e != nil {
+			return e
+		}
+		rel = filepath.ToSlash(rel)
+		rp := base
+		if rel != "." {
+			rp = path.Join(base, rel)
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			w.sym(p, rp, dep)
+			return nil
+		}
+		if d.IsDir() {
+			if rel != "." && w.cfg.flt.Skp(rp) {
+				atomic.AddInt64(&stFlt, 1)
+				logFlt(w.cfg, p, rp)
+				return filepath.SkipDir
 			}
-			q <- Job{L: p, R: rp}
 			return nil
-		})
+		}
+		info, e := d.Info()
+		if e != nil {
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		w.file(p, rp, dep)
+		return nil
+	})
+}
+
+func (w *wk) file(p, rp string, dep int) {
+	if isLnk(p) && w.cfg.Lnk != "keep" {
+		w.lnk(p, rp, dep)
+		return
 	}
+	if !w.cfg.flt.Ok(rp) {
+		atomic.AddInt64(&stFlt, 1)
+		logFlt(w.cfg, p, rp)
+		return
+	}
+	// 取消后 worker 已退出，不能卡在发送上
+	select {
+	case w.q <- Job{L: p, R: rp}:
+		w.n++
+	case <-w.ctx.Done():
+	}
+}
 
-	if !st.Mode().IsRegular() {
-		return nil
+// 快捷方式默认跳过；follow 时备份目标文件或目录，远端放在快捷方式同级、用目标的名字
+func (w *wk) lnk(p, rp string, dep int) {
+	if w.cfg.Lnk != "follow" {
+		atomic.AddInt64(&stFlt, 1)
+		logFlt(w.cfg, p, rp)
+		return
+	}
+	t, err := rdLnk(p)
+	if err != nil {
+		log.Printf("[WRN] lnk %s: %v\n", p, err)
+		return
+	}
+	st, err := os.Stat(t)
+	if err != nil {
+		log.Printf("[WRN] lnk %s -> %s: %v\n", p, t, err)
+		return
+	}
+	if dep >= maxDep || w.seen[t] {
+		log.Printf("[WRN] lnk %s -> %s: loop or too deep\n", p, t)
+		return
+	}
+	w.seen[t] = true
+
+	tr := path.Join(path.Dir(rp), lnkBase(t))
+	dbgLogf("[LNK] %s -> %s\n", p, t)
+	if st.IsDir() {
+		if w.cfg.flt.Skp(tr) {
+			atomic.AddInt64(&stFlt, 1)
+			logFlt(w.cfg, p, tr)
+			return
+		}
+		if err := w.walk(t, tr, dep+1); err != nil {
+			log.Printf("[WRN] lnk %s -> %s: %v\n", p, t, err)
+		}
+		return
+	}
+	if st.Mode().IsRegular() {
+		w.file(t, tr, dep+1)
 	}
-	base := filepath.Base(src)
-	q <- Job{L: src, R: base}
-	return nil
 }
 
-func upOne(ctx context.Context, sto Sto, cfg *Cfg, j Job, dc *DirC) error {
+// 打包的文件在卷上传后才记进报告
+func upOne(ctx context.Context, sto Sto, cfg *Cfg, j Job, rs *Rs) (err error) {
+	rem, z := zipRem(cfg, remP(cfg, j.R))
+	rem, x := encRem(cfg, rem)
+	rs.mir.Add(rem)
+	act := ""
+	defer func() { rs.rp.Add(j.L, rem, act, err) }()
+
 	st, err := os.Stat(j.L)
 	if err != nil {
 		return err
@@ -182,38 +489,194 @@ func upOne(ctx context.Context, sto Sto, cfg *Cfg, j Job, dc *DirC) error {
 	}
 
 	atomic.AddInt64(&stTot, 1)
+	defer rs.prg.Fin(st.Size())
+
+	rec := Rec{Sz: st.Size(), Mt: st.ModTime().UnixNano(), Ok: true}
 
-	rem := j.R
-	if cfg.Root != "" {
-		rem = path.Join(cfg.Root, rem)
+	// 上次没传完或上传失败（远端可能留下半截）的文件不能当作已存在
+	_, part := rs.pj.Get(rem)
+	if r, ok := rs.db.Get(rem); ok && !r.Ok {
+		part = true
+	}
+
+	// 状态库命中时不访问远端
+	if cfg.State && cfg.Mode != "over" && !part && rs.db.Same(rem, st) {
+		atomic.AddInt64(&stSkp, 1)
+		if cfg.Dry {
+			logSkp(cfg, j.L, rem)
+		} else {
+			dbgLogf("[SKIP] %s -> %s (state)\n", j.L, rem)
+		}
+		act = "skip"
+		return nil
+	}
+
+	// 小文件进打包卷，不单独访问远端
+	if rs.pk.Ok(st) {
+		return rs.pk.Add(ctx, sto, cfg, rs, j, rem, st)
 	}
 
 	dp := path.Dir(rem)
-	if dp != "." && dp != "/" {
-		if err := mkDir(ctx, sto, dc, dp); err != nil {
+	if dp != "." && dp != "/" && !cfg.Dry {
+		if err := mkDir(ctx, sto, rs.dc, dp); err != nil {
 			return fmt.Errorf("mkDir %s: %w", dp, err)
 		}
 	}
 
-	if cfg.Mode == "skip" {
+	switch {
+	case part:
+	case cfg.Mode == "skip":
 		ok, err := sto.Has(ctx, rem)
 		if err != nil {
 			return fmt.Errorf("has %s: %w", rem, err)
 		}
 		if ok {
 			atomic.AddInt64(&stSkp, 1)
-			log.Printf("[SKIP] %s -> %s\n", j.L, rem)
+			rs.db.Set(rem, rec)
+			logSkp(cfg, j.L, rem)
+			act = "skip"
+			return nil
+		}
+	case cfg.Mode == "newer" || cfg.Mode == "mirror":
+		e, err := sto.Stat(ctx, rem)
+		if err != nil {
+			return fmt.Errorf("stat %s: %w", rem, err)
+		}
+		if r, ok := rs.db.Get(rem); !isNew(st, e, z || x, r, ok) {
+			atomic.AddInt64(&stSkp, 1)
+			rec.Rt = unixN(e.Mt)
+			rs.db.Set(rem, rec)
+			logSkp(cfg, j.L, rem)
+			act = "skip"
 			return nil
 		}
 	}
 
-	if err := sto.Put(ctx, j.L, rem, st.Size()); err != nil {
+	if cfg.Dry {
+		atomic.AddInt64(&stOk, 1)
+		atomic.AddInt64(&stByt, st.Size())
+		log.Printf("[PLAN] upload %s -> %s (%d bytes)\n", j.L, rem, st.Size())
+		act = "plan"
+		return nil
+	}
+
+	err = doTry(ctx, func() error {
+		return putOne(ctx, sto, cfg, rs.pj, rs.prg, j.L, rem, st, z, x)
+	})
+	if err != nil {
+		rec.Ok = false
+		rs.db.Set(rem, rec)
 		return err
 	}
+	// 记下服务器给的修改时间，下次和它比
+	if rs.db != nil && (cfg.Mode == "newer" || cfg.Mode == "mirror") {
+		if e, err := sto.Stat(ctx, rem); err == nil && e != nil {
+			rec.Rt = unixN(e.Mt)
+		}
+	}
+	rs.db.Set(rem, rec)
 	atomic.AddInt64(&stOk, 1)
+	atomic.AddInt64(&stByt, st.Size())
+	act = "upload"
 	return nil
 }
 
+func logSkp(cfg *Cfg, l, r string) {
+	if cfg.Dry {
+		log.Printf("[PLAN] skip-exists %s -> %s\n", l, r)
+		return
+	}
+	log.Printf("[SKIP] %s -> %s\n", l, r)
+}
+
+func logFlt(cfg *Cfg, l, r string) {
+	if cfg.Dry {
+		log.Printf("[PLAN] filtered %s -> %s\n", l, r)
+		return
+	}
+	dbgLogf("[FLT] %s\n", l)
+}
+
+// 上传一个文件，开启校验时边传边算哈希，校验失败也交给 doTry 重试
+// 大文件先记指纹，中断后指纹不变就从远端已有大小处续传；压缩、加密上传的不续传，校验的是实际上传的内容
+func putOne(ctx context.Context, sto Sto, cfg *Cfg, pj *Pj, pg *Prg, loc, rem string, st os.FileInfo, z, x bool) error {
+	f, err := os.Open(loc)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	src := &Src{R: pg.R(f), L: loc, Sz: st.Size(), Mt: st.ModTime()}
+	defer prgCls(src.R)
+	if z {
+		zr := gzR(src.R, filepath.Base(loc), st.ModTime())
+		defer zr.Close()
+		src.R, src.Sz = zr, -1
+	}
+	if x {
+		er, err := newEncR(src.R, cfg.ek)
+		if err != nil {
+			return err
+		}
+		src.R = er
+		if src.Sz >= 0 {
+			src.Sz = encSz(src.Sz)
+		}
+	}
+	var hs *hsW
+	if cfg.Vfy {
+		hs = mkHs()
+		src.R = io.TeeReader(src.R, hs)
+	}
+
+	var off int64
+	big := pj != nil && !z && !x && st.Size() >= int64(cfg.Resume)<<20
+	if big {
+		fp, err := mkFp(f, st)
+		if err != nil {
+			return err
+		}
+		if off, err = rsmOff(ctx, sto, pj, rem, fp); err != nil {
+			return err
+		}
+		pj.Set(rem, fp)
+		src.Rsm = true
+	}
+
+	if off > 0 {
+		// 校验要覆盖整个文件，已传部分从本地读一遍补进哈希
+		if hs != nil {
+			_, err = io.CopyN(hs, f, off)
+		} else {
+			_, err = f.Seek(off, io.SeekStart)
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("[RSM] %s -> %s @%d\n", loc, rem, off)
+		err = sto.(Rsm).PutAt(ctx, src, rem, off)
+	} else {
+		err = sto.Put(ctx, src, rem)
+	}
+	if err != nil {
+		// 不支持续传时丢掉指纹，下次重试整传
+		if errors.Is(err, errNoRsm) {
+			pj.Del(rem)
+		}
+		// 远端半截文件没删掉，记个空指纹，下次不按已存在跳过也不从它续传
+		if errors.Is(err, errPart) && pj != nil {
+			pj.Set(rem, Fp{})
+		}
+		return err
+	}
+	pj.Del(rem)
+
+	if hs == nil {
+		return nil
+	}
+	return vfy(ctx, sto, rem, hs)
+}
+
 func mkDir(ctx context.Context, sto Sto, dc *DirC, dp string) error {
 	dp = strings.Trim(dp, "/")
 	if dp == "" {
@@ -251,3 +714,10 @@ func mkDir(ctx context.Context, sto Sto, dc *DirC, dp string) error {
 	}
 	return nil
 }
+
+func remP(cfg *Cfg, r string) string {
+	if cfg.Root == "" {
+		return r
+	}
+	return path.Join(cfg.Root, r)
+}
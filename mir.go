@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 默认单次最多删除数，防止配置错误时清空远端
+const defMaxDel = 100
+
+// 本次应保留的远端文件
+type Mir struct {
+	mu  sync.Mutex
+	set map[string]struct{}
+}
+
+func (m *Mir) Add(rem string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.set[strings.Trim(rem, "/")] = struct{}{}
+	m.mu.Unlock()
+}
+
+// 所有源必须存在，目录不能为空；只有垃圾文件或全被过滤的源在遍历后由 run 拒绝
+func ckSrc(cfg *Cfg, dir string) error {
+	for _, s := range cfg.List {
+		if !filepath.IsAbs(s) {
+			s = filepath.Join(dir, s)
+		}
+		st, err := os.Stat(s)
+		if err != nil {
+			return fmt.Errorf("src %s: %w", s, err)
+		}
+		if !st.IsDir() {
+			continue
+		}
+		des, err := os.ReadDir(s)
+		if err != nil {
+			return fmt.Errorf("src %s: %w", s, err)
+		}
+		if len(des) == 0 {
+			return fmt.Errorf("src %s: empty", s)
+		}
+	}
+	return nil
+}
+
+// 挑出要删的远端文件和目录：本次没备份、不是控制文件、没被过滤（本身或上级目录被排除）的
+func mirDel(cfg *Cfg, m *Mir, root string, es []*Ent) (fl, ds []string) {
+	// 保留文件的所有上级目录
+	need := make(map[string]struct{})
+	keep := func(p string) {
+		for d := path.Dir(p); d != "." && d != "/" && d != root; d = path.Dir(d) {
+			need[d] = struct{}{}
+		}
+	}
+
+	for _, e := range es {
+		rel := strings.TrimPrefix(strings.TrimPrefix(e.P, root), "/")
+		if e.Dir {
+			continue
+		}
+		if _, ok := m.set[e.P]; ok || isCtl(rel) || !cfg.flt.Ok(rel) || cfg.flt.Up(rel) {
+			keep(e.P)
+			continue
+		}
+		fl = append(fl, e.P)
+	}
+	for _, e := range es {
+		if !e.Dir {
+			continue
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(e.P, root), "/")
+		if _, ok := need[e.P]; !ok && !cfg.flt.Skp(rel) && !cfg.flt.Up(rel) {
+			ds = append(ds, e.P)
+		}
+	}
+	return fl, ds
+}
+
+// 删除远端有、本地没有的文件和目录；被过滤规则排除的文件不动
+func mirror(ctx context.Context, cfg *Cfg, rs *Rs) error {
+	m := rs.mir
+	sto, err := mkSto(cfg)
+	if err != nil {
+		return err
+	}
+	defer sto.Cls()
+
+	root := strings.Trim(cfg.Root, "/")
+	es, err := sto.Ls(ctx, root, true)
+	if err != nil {
+		return fmt.Errorf("ls %s: %w", root, err)
+	}
+
+	fl, ds := mirDel(cfg, m, root, es)
+
+	// 打包卷里本地已删除的文件也算删除
+	pd := rs.pk.gone(cfg, m)
+
+	// 0 取默认值，负数不限
+	max := cfg.MaxDel
+	if max == 0 {
+		max = defMaxDel
+	}
+	if n := len(fl) + len(ds) + len(pd); max > 0 && n > max {
+		return fmt.Errorf("%d deletions exceed max_del=%d, refused", n, max)
+	}
+
+	for _, p := range fl {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if cfg.Dry {
+			atomic.AddInt64(&stDel, 1)
+			log.Printf("[PLAN] delete %s\n", p)
+			rs.rp.Add("", p, "plan-delete", nil)
+			continue
+		}
+		if err := sto.Del(ctx, p, false); err != nil {
+			rs.rp.Add("", p, "", err)
+			return fmt.Errorf("del %s: %w", p, err)
+		}
+		rs.db.Del(p)
+		atomic.AddInt64(&stDel, 1)
+		log.Printf("[DEL] %s\n", p)
+		rs.rp.Add("", p, "delete", nil)
+	}
+
+	// 深的目录先删
+	sort.Slice(ds, func(i, k int) bool {
+		return strings.Count(ds[i], "/") > strings.Count(ds[k], "/")
+	})
+	for _, p := range ds {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if cfg.Dry {
+			atomic.AddInt64(&stDel, 1)
+			log.Printf("[PLAN] delete %s/\n", p)
+			rs.rp.Add("", p+"/", "plan-delete", nil)
+			continue
+		}
+		if err := sto.Del(ctx, p, true); err != nil {
+			rs.rp.Add("", p+"/", "", err)
+			return fmt.Errorf("del %s: %w", p, err)
+		}
+		atomic.AddInt64(&stDel, 1)
+		log.Printf("[DEL] %s/\n", p)
+		rs.rp.Add("", p+"/", "delete", nil)
+	}
+	if err := rs.pk.gc(ctx, sto, cfg, rs, pd); err != nil {
+		return fmt.Errorf("pack gc: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// 被剪掉的目录里的文件和子目录不删
+func TestMirDel(t *testing.T) {
+	f, err := mkFlt(&Cfg{Exc: []string{"cache", "re:^p/node_modules$"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Cfg{flt: f}
+	m := &Mir{set: map[string]struct{}{"bk/p/a.txt": {}}}
+	es := []*Ent{
+		{P: "bk/p", Dir: true},
+		{P: "bk/p/a.txt"},
+		{P: "bk/p/old.txt"},
+		{P: "bk/p/cache", Dir: true},
+		{P: "bk/p/cache/x.txt"},
+		{P: "bk/p/cache/sub", Dir: true},
+		{P: "bk/p/node_modules", Dir: true},
+		{P: "bk/p/node_modules/m/i.js"},
+		{P: "bk/p/gone", Dir: true},
+		{P: "bk/p/gone/y.txt"},
+		{P: "bk/p/z.tmp"},
+	}
+	fl, ds := mirDel(cfg, m, "bk", es)
+	if want := []string{"bk/p/old.txt", "bk/p/gone/y.txt"}; !reflect.DeepEqual(fl, want) {
+		t.Errorf("files = %v, want %v", fl, want)
+	}
+	if want := []string{"bk/p/gone"}; !reflect.DeepEqual(ds, want) {
+		t.Errorf("dirs = %v, want %v", ds, want)
+	}
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 小文件打包：小于 pack KB 的文件写进本地临时 tar 卷，卷到 pack_max MB 或运行结束时整卷上传，
+// 卷和普通文件一样按配置压缩、加密。每卷一个索引，记录文件在 tar 流里的偏移，restore 据此取出单个文件
+const (
+	packDir    = ctlDir + "/pack"
+	defPackMax = 64
+)
+
+// 索引项，P 为相对 root 的路径，Off 为内容在 tar 流里的偏移
+type PkE struct {
+	P   string `json:"p"`
+	Off int64  `json:"off"`
+	Sz  int64  `json:"sz"`
+	Mt  int64  `json:"mt"`
+}
+
+// 一卷的索引，Vol 为同目录下卷的文件名（含压缩、加密后缀）
+type PkIx struct {
+	Vol   string `json:"vol"`
+	Files []PkE  `json:"files"`
+	n     string // 索引自己的远端路径
+}
+
+type pkF struct {
+	l   string
+	rem string
+	rec Rec
+}
+
+// 正在写的卷
+type pkV struct {
+	name string
+	f    *os.File
+	cw   *cntW
+	tw   *tar.Writer
+	ix   []PkE
+	fs   []pkF
+	byt  int64
+}
+
+type Pk struct {
+	mu  sync.Mutex
+	lim int64
+	max int64
+	run string
+	seq int
+	old map[string]PkE
+	ixs []*PkIx         // 运行开始时远端已有的索引，gc 用
+	nw  map[string]bool // 本次已打进新卷并上传成功的路径
+	cur *pkV
+}
+
+type cntW struct {
+	w io.Writer
+	n int64
+}
+
+func (c *cntW) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// 读远端已有索引，用于 skip/newer 判断和结束时清理旧卷
+func opPk(ctx context.Context, cfg *Cfg) (*Pk, error) {
+	max := cfg.PackMax
+	if max <= 0 {
+		max = defPackMax
+	}
+	p := &Pk{
+		lim: int64(cfg.Pack) << 10,
+		max: int64(max) << 20,
+		run: time.Now().Format("20060102-150405.000000"),
+		old: make(map[string]PkE),
+		nw:  make(map[string]bool),
+	}
+	sto, err := mkSto(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer sto.Cls()
+	ixs, err := ldPk(ctx, sto, remP(cfg, packDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, ix := range ixs {
+		for _, e := range ix.Files {
+			p.old[e.P] = e
+		}
+	}
+	p.ixs = ixs
+	log.Printf("pack index=%d files=%d\n", len(ixs), len(p.old))
+	return p, nil
+}
+
+// 按卷名顺序读出 dir 下所有索引，后面的卷覆盖前面的
+func ldPk(ctx context.Context, sto Sto, dir string) ([]*PkIx, error) {
+	dir = strings.Trim(dir, "/")
+	es, err := sto.Ls(ctx, dir, false)
+	if err != nil {
+		return nil, fmt.Errorf("ls %s: %w", dir, err)
+	}
+	sort.Slice(es, func(i, k int) bool { return es[i].P < es[k].P })
+	var out []*PkIx
+	for _, e := range es {
+		if e.Dir || !strings.HasSuffix(e.P, ".json") {
+			continue
+		}
+		rc, err := sto.Get(ctx, e.P)
+		if err != nil {
+			return nil, fmt.Errorf("get %s: %w", e.P, err)
+		}
+		ix := &PkIx{n: e.P}
+		err = json.NewDecoder(rc).Decode(ix)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", e.P, err)
+		}
+		out = append(out, ix)
+	}
+	return out, nil
+}
+
+// 是否走打包
+func (p *Pk) Ok(st os.FileInfo) bool {
+	return p != nil && st.Size() < p.lim
+}
+
+// 把一个小文件写进当前卷，卷满时由当前 worker 上传
+func (p *Pk) Add(ctx context.Context, sto Sto, cfg *Cfg, rs *Rs, j Job, rem string, st os.FileInfo) error {
+	rec := Rec{Sz: st.Size(), Mt: st.ModTime().UnixNano(), Ok: true}
+	if o, ok := p.old[j.R]; ok && cfg.Mode != "over" {
+		if d := rec.Mt - o.Mt; cfg.Mode == "skip" || o.Sz == st.Size() && d >= -int64(mtTol) && d <= int64(mtTol) {
+			atomic.AddInt64(&stSkp, 1)
+			rs.db.Set(rem, rec)
+			logSkp(cfg, j.L, rem)
+			rs.rp.Add(j.L, rem, "skip", nil)
+			return nil
+		}
+	}
+	if cfg.Dry {
+		atomic.AddInt64(&stOk, 1)
+		atomic.AddInt64(&stByt, st.Size())
+		log.Printf("[PLAN] pack %s -> %s (%d bytes)\n", j.L, j.R, st.Size())
+		rs.rp.Add(j.L, rem, "plan", nil)
+		return nil
+	}
+
+	// 小文件先读进内存，写卷时不会因本地读失败弄坏 tar；多读一个字节，读的时候文件变了就报错，
+	// 不把截断的内容当完整的存进去
+	f, err := os.Open(j.L)
+	if err != nil {
+		return err
+	}
+	b, err := io.ReadAll(io.LimitReader(f, st.Size()+1))
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if int64(len(b)) != st.Size() {
+		return fmt.Errorf("pack %s: size changed while reading (%d -> %d)", j.L, st.Size(), len(b))
+	}
+
+	p.mu.Lock()
+	if p.cur == nil {
+		if p.cur, err = p.newV(); err != nil {
+			p.mu.Unlock()
+			return err
+		}
+	}
+	v := p.cur
+	h := &tar.Header{
+		Name:     j.R,
+		Mode:     0o644,
+		Size:     int64(len(b)),
+		ModTime:  st.ModTime(),
+		Typeflag: tar.TypeReg,
+		Format:   tar.FormatPAX,
+	}
+	if err = v.tw.WriteHeader(h); err == nil {
+		off := v.cw.n
+		if _, err = v.tw.Write(b); err == nil {
+			v.ix = append(v.ix, PkE{P: j.R, Off: off, Sz: int64(len(b)), Mt: rec.Mt})
+			v.fs = append(v.fs, pkF{l: j.L, rem: rem, rec: rec})
+			v.byt += int64(len(b))
+		}
+	}
+	if err != nil {
+		// 本地临时文件写失败，整卷作废
+		p.cur = nil
+		p.mu.Unlock()
+		v.drop()
+		v.fail(rs, err)
+		return fmt.Errorf("pack %s: %w", v.name, err)
+	}
+	if v.cw.n < p.max {
+		p.mu.Unlock()
+		dbgLogf("[PACK] %s -> %s\n", j.L, v.name)
+		return nil
+	}
+	p.cur = nil
+	p.mu.Unlock()
+	p.put(ctx, sto, cfg, rs, v)
+	return nil
+}
+
+func (p *Pk) newV() (*pkV, error) {
+	f, err := os.CreateTemp("", "wdbak-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	p.seq++
+	cw := &cntW{w: f}
+	return &pkV{
+		name: fmt.Sprintf("%s-%04d", p.run, p.seq),
+		f:    f,
+		cw:   cw,
+		tw:   tar.NewWriter(cw),
+	}, nil
+}
+
+func (v *pkV) drop() {
+	v.f.Close()
+	os.Remove(v.f.Name())
+}
+
+// 卷里的文件都算失败，状态库标记为没传完
+func (v *pkV) fail(rs *Rs, err error) {
+	atomic.AddInt64(&stErr, int64(len(v.fs)))
+	err = fmt.Errorf("pack %s: %w", v.name, err)
+	for _, f := range v.fs {
+		f.rec.Ok = false
+		rs.db.Set(f.rem, f.rec)
+		addK(err)
+		rs.rp.Add(f.l, f.rem, "", err)
+	}
+}
+
+// 运行结束时上传最后一卷
+func (p *Pk) Done(ctx context.Context, cfg *Cfg, rs *Rs) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	v := p.cur
+	p.cur = nil
+	p.mu.Unlock()
+	if v == nil {
+		return
+	}
+	if ctx.Err() != nil {
+		v.drop()
+		v.fail(rs, ctx.Err())
+		log.Printf("[ERR] pack %s (%d files): %v\n", v.name, len(v.fs), ctx.Err())
+		return
+	}
+	sto, err := mkSto(cfg)
+	if err != nil {
+		v.drop()
+		v.fail(rs, err)
+		log.Printf("[ERR] pack %s: %v\n", v.name, err)
+		return
+	}
+	defer sto.Cls()
+	p.put(ctx, sto, cfg, rs, v)
+}
+
+// 先传卷再传索引，索引在才算这批文件传成功
+func (p *Pk) put(ctx context.Context, sto Sto, cfg *Cfg, rs *Rs, v *pkV) {
+	defer v.drop()
+	err := v.tw.Close()
+	if err == nil {
+		err = p.putV(ctx, sto, cfg, rs, v)
+	}
+	if err != nil {
+		v.fail(rs, err)
+		log.Printf("[ERR] pack %s (%d files): %v\n", v.name, len(v.fs), err)
+		return
+	}
+	for _, f := range v.fs {
+		rs.db.Set(f.rem, f.rec)
+		rs.rp.Add(f.l, f.rem, "pack", nil)
+	}
+	p.mu.Lock()
+	for _, e := range v.ix {
+		p.nw[e.P] = true
+	}
+	p.mu.Unlock()
+	atomic.AddInt64(&stOk, int64(len(v.fs)))
+	atomic.AddInt64(&stByt, v.byt)
+	log.Printf("[PACK] %s (%d files, %d bytes)\n", v.name, len(v.fs), v.cw.n)
+}
+
+func (p *Pk) putV(ctx context.Context, sto Sto, cfg *Cfg, rs *Rs, v *pkV) error {
+	st, err := v.f.Stat()
+	if err != nil {
+		return err
+	}
+	vrem, z := zipRem(cfg, remP(cfg, packDir+"/"+v.name+".tar"))
+	vrem, x := encRem(cfg, vrem)
+	if err := mkDir(ctx, sto, rs.dc, path.Dir(vrem)); err != nil {
+		return fmt.Errorf("mkDir %s: %w", path.Dir(vrem), err)
+	}
+	err = doTry(ctx, func() error {
+		return putOne(ctx, sto, cfg, nil, rs.prg, v.f.Name(), vrem, st, z, x)
+	})
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(&PkIx{Vol: path.Base(vrem), Files: v.ix})
+	if err != nil {
+		return err
+	}
+	return putB(ctx, sto, rs.dc, remP(cfg, packDir+"/"+v.name+".json"), b)
+}
+
+// 打包文件对应的普通远端路径，与 upOne 里 Mir.Add 的一致
+func pkRem(cfg *Cfg, p string) string {
+	rem, _ := zipRem(cfg, remP(cfg, p))
+	rem, _ = encRem(cfg, rem)
+	return strings.Trim(rem, "/")
+}
+
+// 镜像时本地已删除的打包文件：本次没见到且没被过滤
+func (p *Pk) gone(cfg *Cfg, m *Mir) []string {
+	if p == nil || m == nil {
+		return nil
+	}
+	var out []string
+	seen := make(map[string]bool)
+	for _, ix := range p.ixs {
+		for _, e := range ix.Files {
+			if seen[e.P] || !cfg.flt.Ok(e.P) {
+				continue
+			}
+			seen[e.P] = true
+			if _, ok := m.set[pkRem(cfg, e.P)]; !ok {
+				out = append(out, e.P)
+			}
+		}
+	}
+	return out
+}
+
+// 清理旧索引：去掉被后面的卷或本次新卷取代的项，以及 del 里的项（镜像时本地已删除的）；
+// 索引变空时连卷一起删，否则重写索引。先删索引再删卷，中途失败也不会留下指向不存在卷的索引。
+// sto 为 nil 时有要改的才连接
+func (p *Pk) gc(ctx context.Context, sto Sto, cfg *Cfg, rs *Rs, del []string) error {
+	if p == nil || len(p.ixs) == 0 {
+		return nil
+	}
+	dm := make(map[string]bool, len(del))
+	for _, d := range del {
+		dm[d] = true
+	}
+	last := make(map[string]int)
+	for i, ix := range p.ixs {
+		for _, e := range ix.Files {
+			last[e.P] = i
+		}
+	}
+
+	own := sto == nil
+	defer func() {
+		if own && sto != nil {
+			sto.Cls()
+		}
+	}()
+	nd, nv := 0, 0
+	for i, ix := range p.ixs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var keep []PkE
+		for _, e := range ix.Files {
+			switch {
+			case last[e.P] != i, p.nw[e.P]:
+			case dm[e.P]:
+				rem := pkRem(cfg, e.P)
+				atomic.AddInt64(&stDel, 1)
+				if cfg.Dry {
+					log.Printf("[PLAN] delete %s (pack)\n", rem)
+					rs.rp.Add("", rem, "plan-delete", nil)
+				} else {
+					log.Printf("[DEL] %s (pack)\n", rem)
+					rs.rp.Add("", rem, "delete", nil)
+					rs.db.Del(rem)
+				}
+			default:
+				keep = append(keep, e)
+			}
+		}
+		if len(keep) == len(ix.Files) {
+			continue
+		}
+		nd += len(ix.Files) - len(keep)
+		if cfg.Dry {
+			continue
+		}
+		if sto == nil {
+			s, err := mkSto(cfg)
+			if err != nil {
+				return err
+			}
+			sto = s
+		}
+		if len(keep) > 0 {
+			b, err := json.Marshal(&PkIx{Vol: ix.Vol, Files: keep})
+			if err != nil {
+				return err
+			}
+			if err := putB(ctx, sto, rs.dc, ix.n, b); err != nil {
+				return err
+			}
+			dbgLogf("[PACK] %s: %d -> %d files\n", ix.n, len(ix.Files), len(keep))
+			continue
+		}
+		if err := sto.Del(ctx, ix.n, false); err != nil {
+			return fmt.Errorf("del %s: %w", ix.n, err)
+		}
+		vol := path.Join(path.Dir(ix.n), ix.Vol)
+		if err := sto.Del(ctx, vol, false); err != nil {
+			return fmt.Errorf("del %s: %w", vol, err)
+		}
+		nv++
+		dbgLogf("[PACK] removed %s\n", vol)
+	}
+	if nd > 0 {
+		pre := ""
+		if cfg.Dry {
+			pre = "[PLAN] "
+		}
+		log.Printf("%spack gc: drop=%d vol=%d\n", pre, nd, nv)
+	}
+	return nil
+}
+
+// 从打包卷里恢复 src 本身或其下的文件，have 为已按普通文件恢复的相对路径和远端修改时间，较新的不再覆盖
+func rstPk(ctx context.Context, sto Sto, cfg *Cfg, src, dst string, o *rstO, have map[string]time.Time) error {
+	md, e, err := ctlUp(ctx, sto, src, strings.Trim(cfg.Root, "/"), "pack")
+	if err != nil || e == nil || !e.Dir {
+		return err
+	}
+	dir := path.Join(md, packDir)
+	ixs, err := ldPk(ctx, sto, dir)
+	if err != nil {
+		return err
+	}
+
+	// 同一路径以最后一卷为准
+	type it struct {
+		PkE
+		vol string
+		rel string
+	}
+	m := make(map[string]it)
+	for _, ix := range ixs {
+		for _, f := range ix.Files {
+			rel := strings.Trim(path.Join(md, f.P), "/")
+			switch {
+			case src == "":
+			case rel == src:
+				rel = path.Base(rel)
+			case strings.HasPrefix(rel, src+"/"):
+				rel = strings.TrimPrefix(rel, src+"/")
+			default:
+				continue
+			}
+			m[rel] = it{PkE: f, vol: path.Join(dir, ix.Vol), rel: rel}
+		}
+	}
+	vs := make(map[string][]it)
+	for rel, f := range m {
+		if mt, ok := have[rel]; ok && mt.UnixNano() >= f.Mt {
+			continue
+		}
+		vs[f.vol] = append(vs[f.vol], f)
+	}
+
+	for vol, fs := range vs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		sort.Slice(fs, func(i, k int) bool { return fs[i].Off < fs[k].Off })
+		var es []PkE
+		var ls []string
+		for _, f := range fs {
+			es = append(es, f.PkE)
+			ls = append(ls, f.rel)
+		}
+		if err := rstV(ctx, sto, vol, es, ls, dst, o); err != nil {
+			atomic.AddInt64(&stErr, 1)
+			log.Printf("[ERR] pack %s: %v\n", vol, err)
+		}
+	}
+	return nil
+}
+
+// 顺序读一卷，按偏移取出 es，ls 为对应的本地相对路径
+func rstV(ctx context.Context, sto Sto, vol string, es []PkE, ls []string, dst string, o *rstO) error {
+	rc, err := sto.Get(ctx, vol)
+	if err != nil {
+		return fmt.Errorf("get %s: %w", vol, err)
+	}
+	defer rc.Close()
+	var r io.Reader = rc
+	n := strings.TrimSuffix(vol, encSuf)
+	if n != vol {
+		if o.ek == nil {
+			return fmt.Errorf("get %s: encrypted, key not set", vol)
+		}
+		if r, err = newDecR(r, o.ek); err != nil {
+			return err
+		}
+	}
+	if strings.HasSuffix(n, zipSuf) {
+		r, _, _ = unZip(r)
+	}
+
+	var pos int64
+	for i, e := range es {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if _, err := io.CopyN(io.Discard, r, e.Off-pos); err != nil {
+			return err
+		}
+		pos = e.Off
+		atomic.AddInt64(&stTot, 1)
+		lp, err := locP(dst, ls[i])
+		if err != nil {
+			atomic.AddInt64(&stErr, 1)
+			log.Printf("[ERR] %v\n", err)
+			continue
+		}
+		if o.skp {
+			if _, err := os.Stat(lp); err == nil {
+				atomic.AddInt64(&stSkp, 1)
+				log.Printf("[SKIP] %s -> %s\n", vol, lp)
+				continue
+			}
+		}
+		if o.tst {
+			if _, err := io.CopyN(io.Discard, r, e.Sz); err != nil {
+				return err
+			}
+		} else if err := rstF(r, lp, e); err != nil {
+			return err
+		}
+		pos += e.Sz
+		atomic.AddInt64(&stOk, 1)
+		dbgLogf("[OK ] %s@%d -> %s\n", vol, e.Off, lp)
+	}
+	return nil
+}
+
+func rstF(r io.Reader, lp string, e PkE) error {
+	if err := os.MkdirAll(filepath.Dir(lp), 0o755); err != nil {
+		return err
+	}
+	tmp := lp + ".wdbak.tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(f, r, e.Sz)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, lp)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	mt := time.Unix(0, e.Mt)
+	_ = os.Chtimes(lp, mt, mt)
+	return nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 内存里的远端，只实现测试用到的行为
+type memSto struct {
+	mu sync.Mutex
+	m  map[string][]byte
+}
+
+func newMem() *memSto { return &memSto{m: make(map[string][]byte)} }
+
+func (s *memSto) Put(ctx context.Context, src *Src, rem string) error {
+	b, err := io.ReadAll(src.R)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.m[strings.Trim(rem, "/")] = b
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memSto) Has(ctx context.Context, rem string) (bool, error) {
+	e, err := s.Stat(ctx, rem)
+	return e != nil, err
+}
+
+func (s *memSto) Stat(ctx context.Context, rem string) (*Ent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.m[strings.Trim(rem, "/")]; ok {
+		return &Ent{P: rem, Sz: int64(len(b))}, nil
+	}
+	return nil, nil
+}
+
+// 只列文件
+func (s *memSto) Ls(ctx context.Context, dir string, deep bool) ([]*Ent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pre := strings.Trim(dir, "/") + "/"
+	var out []*Ent
+	for k, b := range s.m {
+		if !strings.HasPrefix(k, pre) || !deep && strings.Contains(k[len(pre):], "/") {
+			continue
+		}
+		out = append(out, &Ent{P: k, Sz: int64(len(b))})
+	}
+	return out, nil
+}
+
+func (s *memSto) Get(ctx context.Context, rem string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.m[strings.Trim(rem, "/")]
+	if !ok {
+		return nil, &StoE{Op: "get", P: rem, K: ErrNotFound, Err: os.ErrNotExist}
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *memSto) Del(ctx context.Context, rem string, dir bool) error {
+	s.mu.Lock()
+	delete(s.m, strings.Trim(rem, "/"))
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memSto) Mk(ctx context.Context, dir string) error { return nil }
+func (s *memSto) Cls()                                     {}
+
+func (s *memSto) keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ks []string
+	for k := range s.m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
+
+// 把几个小文件打成一卷，返回卷内容和索引
+func mkVol(t *testing.T, fs map[string]string) ([]byte, []PkE) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &Cfg{Mode: "over"}
+	p := &Pk{lim: 1 << 20, max: 1 << 30, run: "t", old: make(map[string]PkE), nw: make(map[string]bool)}
+	var ns []string
+	for n := range fs {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	mt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, n := range ns {
+		l := filepath.Join(dir, n)
+		if err := os.WriteFile(l, []byte(fs[n]), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(l, mt, mt); err != nil {
+			t.Fatal(err)
+		}
+		st, err := os.Stat(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Add(context.Background(), nil, cfg, &Rs{}, Job{L: l, R: "d/" + n}, "d/"+n, st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v := p.cur
+	defer v.drop()
+	if err := v.tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(v.f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, v.ix
+}
+
+// 只取部分文件，跳过的和没要的都得按偏移读过去
+func TestRstV(t *testing.T) {
+	fs := map[string]string{
+		"a.txt": "aaa",
+		"b.txt": strings.Repeat("b", 1000),
+		"c.txt": "",
+		"d.txt": strings.Repeat("d", 700),
+		"e.txt": "eeeee",
+	}
+	b, ix := mkVol(t, fs)
+	if len(ix) != len(fs) {
+		t.Fatalf("index has %d entries", len(ix))
+	}
+	ek, err := mkEk("pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, vol := range []string{"p/v.tar", "p/v.tar.gz.enc"} {
+		s := newMem()
+		vb := b
+		if strings.HasSuffix(vol, encSuf) {
+			zr := gzR(bytes.NewReader(b), "v.tar", time.Now())
+			er, err := newEncR(zr, ek)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if vb, err = io.ReadAll(er); err != nil {
+				t.Fatal(err)
+			}
+			zr.Close()
+		}
+		s.m[vol] = vb
+
+		dst := t.TempDir()
+		// b 本地已有，skip 模式下跳过
+		if err := os.WriteFile(filepath.Join(dst, "b.txt"), []byte("local"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		es := []PkE{ix[0], ix[1], ix[2], ix[4]}
+		var ls []string
+		for _, e := range es {
+			ls = append(ls, path.Base(e.P))
+		}
+		if err := rstV(context.Background(), s, vol, es, ls, dst, &rstO{skp: true, ek: ek}); err != nil {
+			t.Fatalf("%s: %v", vol, err)
+		}
+		want := map[string]string{"a.txt": "aaa", "b.txt": "local", "c.txt": "", "e.txt": "eeeee"}
+		for n, w := range want {
+			got, err := os.ReadFile(filepath.Join(dst, n))
+			if err != nil {
+				t.Errorf("%s %s: %v", vol, n, err)
+				continue
+			}
+			if string(got) != w {
+				t.Errorf("%s %s: got %q, want %q", vol, n, got, w)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(dst, "d.txt")); !os.IsNotExist(err) {
+			t.Errorf("%s: d.txt restored", vol)
+		}
+		if st, err := os.Stat(filepath.Join(dst, "e.txt")); err == nil && st.ModTime().UnixNano() != ix[4].Mt {
+			t.Errorf("%s: e.txt mtime %v", vol, st.ModTime())
+		}
+	}
+}
+
+func putIx(t *testing.T, s *memSto, n string, ps ...string) {
+	t.Helper()
+	ix := PkIx{Vol: n + ".tar"}
+	for i, p := range ps {
+		ix.Files = append(ix.Files, PkE{P: p, Off: int64(i) * 1024, Sz: 1})
+	}
+	b, err := json.Marshal(&ix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.m[packDir+"/"+n+".json"] = b
+	s.m[packDir+"/"+n+".tar"] = []byte("vol")
+}
+
+func ixFiles(t *testing.T, s *memSto, n string) []string {
+	t.Helper()
+	var ix PkIx
+	if err := json.Unmarshal(s.m[packDir+"/"+n+".json"], &ix); err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, e := range ix.Files {
+		out = append(out, e.P)
+	}
+	return out
+}
+
+// 被后面的卷、本次新卷取代的项和本地已删除的项从索引里去掉，索引空了连卷一起删
+func TestPkGc(t *testing.T) {
+	s := newMem()
+	putIx(t, s, "v1", "a", "b")
+	putIx(t, s, "v2", "a", "b", "c")
+	putIx(t, s, "v3", "d", "e")
+	putIx(t, s, "v4", "f")
+	v4 := s.m[packDir+"/v4.json"]
+
+	ctx := context.Background()
+	ixs, err := ldPk(ctx, s, packDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Pk{ixs: ixs, nw: map[string]bool{"c": true}}
+	rs := &Rs{dc: &DirC{set: make(map[string]struct{})}}
+	cfg := &Cfg{}
+
+	// 演练不改远端
+	cfg.Dry = true
+	if err := p.gc(ctx, s, cfg, rs, []string{"d"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.keys()) != 8 {
+		t.Fatalf("dry run changed remote: %v", s.keys())
+	}
+
+	cfg.Dry = false
+	if err := p.gc(ctx, s, cfg, rs, []string{"d"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		packDir + "/v2.json", packDir + "/v2.tar",
+		packDir + "/v3.json", packDir + "/v3.tar",
+		packDir + "/v4.json", packDir + "/v4.tar",
+	}
+	if got := s.keys(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("remote = %v, want %v", got, want)
+	}
+	if got := ixFiles(t, s, "v2"); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("v2 = %v", got)
+	}
+	if got := ixFiles(t, s, "v3"); !reflect.DeepEqual(got, []string{"e"}) {
+		t.Errorf("v3 = %v", got)
+	}
+	if !bytes.Equal(s.m[packDir+"/v4.json"], v4) {
+		t.Error("v4 rewritten")
+	}
+}
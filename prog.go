@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 默认非终端下每隔多少秒打一行进度
+const defProg = 60
+
+// 进度：总数来自后台预扫描，扫描完之前是估计值；已完成字节含跳过的文件，速度只算实际读出的字节
+type Prg struct {
+	totF int64
+	totB int64
+	scan int32 // 预扫描完成为 1
+	fin  int64
+	finB int64
+	cur  int64 // 正在传的文件已读字节
+	byt  int64 // 累计读出的字节，算速度用
+
+	tty  bool
+	iv   time.Duration
+	t0   time.Time
+	lb   int64
+	lt   time.Time
+	rate float64
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// prog<0 或试运行时关闭，返回 nil
+func mkPrg(cfg *Cfg) *Prg {
+	if cfg.Prog < 0 || cfg.Dry {
+		return nil
+	}
+	tty := ttyErr()
+	iv := time.Second
+	if !tty {
+		iv = time.Duration(cfg.Prog) * time.Second
+		if iv <= 0 {
+			iv = defProg * time.Second
+		}
+	}
+	return &Prg{tty: tty, iv: iv, stop: make(chan struct{})}
+}
+
+func ttyErr() bool {
+	st, err := os.Stderr.Stat()
+	if err != nil {
+		return false
+	}
+	return st.Mode()&os.ModeCharDevice != 0
+}
+
+// 开始预扫描和定时输出
+func (p *Prg) Run(ctx context.Context, cfg *Cfg, dir string) {
+	if p == nil {
+		return
+	}
+	p.t0 = time.Now()
+	p.lt = p.t0
+	if p.tty {
+		// 日志行先清掉进度行，下次刷新再画
+		lgw.setCon(&clrW{w: os.Stderr})
+	}
+	go func() {
+		for _, s := range cfg.List {
+			if ctx.Err() != nil {
+				return
+			}
+			if !filepath.IsAbs(s) {
+				s = filepath.Join(dir, s)
+			}
+			p.scanSrc(ctx, cfg, filepath.Clean(s))
+		}
+		atomic.StoreInt32(&p.scan, 1)
+	}()
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		t := time.NewTicker(p.iv)
+		defer t.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				p.show()
+			}
+		}
+	}()
+}
+
+// 只按过滤规则数普通文件，不跟随快捷方式和符号链接，够估算用
+func (p *Prg) scanSrc(ctx context.Context, cfg *Cfg, src string) {
+	st, err := os.Stat(src)
+	if err != nil {
+		return
+	}
+	if !st.IsDir() {
+		p.addTot(st.Size())
+		return
+	}
+	base := filepath.Base(src)
+	_ = filepath.WalkDir(src, func(q string, d fs.DirEntry, e error) error {
+		if e != nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, e := filepath.Rel(src, q)
+		if e != nil || rel == "." {
+			return nil
+		}
+		rp := path.Join(base, filepath.ToSlash(rel))
+		if d.IsDir() {
+			if cfg.flt.Skp(rp) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !cfg.flt.Ok(rp) || isLnk(q) && cfg.Lnk != "keep" {
+			return nil
+		}
+		if info, e := d.Info(); e == nil {
+			p.addTot(info.Size())
+		}
+		return nil
+	})
+}
+
+func (p *Prg) addTot(n int64) {
+	atomic.AddInt64(&p.totF, 1)
+	atomic.AddInt64(&p.totB, n)
+}
+
+// 一个文件处理完，sz 为本地大小
+func (p *Prg) Fin(sz int64) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.fin, 1)
+	atomic.AddInt64(&p.finB, sz)
+}
+
+// 包一层计数读，传完或失败后 Cls 把这次读的从 cur 扣掉，完成的字节由 Fin 计；p 为 nil 时原样返回
+func (p *Prg) R(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &prgR{r: r, p: p}
+}
+
+type prgR struct {
+	r io.Reader
+	p *Prg
+	n int64
+}
+
+func (r *prgR) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.n += int64(n)
+		atomic.AddInt64(&r.p.cur, int64(n))
+		atomic.AddInt64(&r.p.byt, int64(n))
+	}
+	return n, err
+}
+
+func prgCls(r io.Reader) {
+	if x, ok := r.(*prgR); ok {
+		atomic.AddInt64(&x.p.cur, -x.n)
+		x.n = 0
+	}
+}
+
+func (p *Prg) show() {
+	now := time.Now()
+	b := atomic.LoadInt64(&p.byt)
+	if dt := now.Sub(p.lt).Seconds(); dt > 0 {
+		cur := float64(b-p.lb) / dt
+		if p.rate == 0 {
+			p.rate = cur
+		} else {
+			p.rate = 0.7*p.rate + 0.3*cur
+		}
+	}
+	p.lb, p.lt = b, now
+
+	fin := atomic.LoadInt64(&p.fin)
+	finB := atomic.LoadInt64(&p.finB) + atomic.LoadInt64(&p.cur)
+	totF := atomic.LoadInt64(&p.totF)
+	totB := atomic.LoadInt64(&p.totB)
+	est := ""
+	if atomic.LoadInt32(&p.scan) == 0 {
+		est = "~"
+	}
+	// 打包卷上传时卷里的文件已算完成，会多出一点；预扫描没数到的文件也会让已完成超过总数
+	if fin > totF {
+		totF = fin
+	}
+	if finB > totB {
+		totB = finB
+	}
+	eta := "-"
+	if p.rate > 0 && totB > finB {
+		// 速度太低时算出来没意义，还会溢出
+		if sec := float64(totB-finB) / p.rate; sec < 1e7 {
+			eta = (time.Duration(sec) * time.Second).String()
+		}
+	}
+	s := fmt.Sprintf("files %d/%s%d  %s/%s%s  %.2f MB/s  ETA %s",
+		fin, est, totF, hSz(finB), est, hSz(totB), p.rate/(1<<20), eta)
+	if p.tty {
+		fmt.Fprintf(os.Stderr, "\r%s\033[K", s)
+		return
+	}
+	log.Printf("[PRG] %s\n", s)
+}
+
+// 停止输出，终端下清掉进度行
+func (p *Prg) Stop() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	p.wg.Wait()
+	if p.tty {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+		lgw.setCon(os.Stderr)
+	}
+	log.Printf("elapsed %s\n", time.Since(p.t0).Round(time.Second))
+}
+
+// 日志写之前清掉当前行
+type clrW struct {
+	w io.Writer
+}
+
+func (c *clrW) Write(b []byte) (int, error) {
+	if _, err := io.WriteString(c.w, "\r\033[K"); err != nil {
+		return 0, err
+	}
+	return c.w.Write(b)
+}
+
+func hSz(n int64) string {
+	const u = 1024
+	if n < u {
+		return fmt.Sprintf("%d B", n)
+	}
+	f := float64(n)
+	for _, s := range []string{"KB", "MB", "GB", "TB"} {
+		f /= u
+		if f < u || s == "TB" {
+			return fmt.Sprintf("%.1f %s", f, s)
+		}
+	}
+	return ""
+}
@@ -2,15 +2,65 @@ package main
 
 import (
 	"context"
+	"errors"
+	"io/fs"
+	"math/rand"
 	"time"
 )
 
-func doTry(ctx context.Context, max int, fn func() error) error {
-	if max < 1 {
-		max = 1
+// 重试策略，Max 为总尝试次数；延迟按 Base 翻倍，不超过 Cap，再上下浮动 Jit%
+type Try struct {
+	Max  int `json:"max"`
+	Base int `json:"base_ms"`
+	Cap  int `json:"max_ms"`
+	Jit  int `json:"jitter"`
+}
+
+// 0 取默认值，jitter<0 为不浮动
+var tryP = Try{Max: 3, Base: 1000, Cap: 30000, Jit: 20}
+
+func setTry(t Try) {
+	if t.Max > 0 {
+		tryP.Max = t.Max
+	}
+	if t.Base > 0 {
+		tryP.Base = t.Base
+	}
+	if t.Cap > 0 {
+		tryP.Cap = t.Cap
+	}
+	switch {
+	case t.Jit < 0:
+		tryP.Jit = 0
+	case t.Jit > 100:
+		tryP.Jit = 100
+	case t.Jit > 0:
+		tryP.Jit = t.Jit
+	}
+}
+
+// 第 i 次失败后的等待
+func (t Try) wait(i int) time.Duration {
+	d := time.Duration(t.Base) * time.Millisecond
+	c := time.Duration(t.Cap) * time.Millisecond
+	for ; i > 0 && d < c; i-- {
+		d *= 2
 	}
+	if t.Jit > 0 {
+		j := float64(t.Jit) / 100
+		d = time.Duration(float64(d) * (1 - j + 2*j*rand.Float64()))
+	}
+	if d > c {
+		d = c
+	}
+	return d
+}
+
+// 按 tryP 重试，不可重试的错误直接返回
+func doTry(ctx context.Context, fn func() error) error {
+	t := tryP
 	var err error
-	for i := 0; i < max; i++ {
+	for i := 0; i < t.Max; i++ {
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
@@ -18,11 +68,33 @@ func doTry(ctx context.Context, max int, fn func() error) error {
 		if err == nil {
 			return nil
 		}
-		if i < max-1 {
-			// 1,2,4 秒
-			sec := 1 << i
-			time.Sleep(time.Duration(sec) * time.Second)
+		if noTry(err) || i == t.Max-1 {
+			break
+		}
+		d := t.wait(i)
+		dbgLogf("[TRY] %d/%d %v, wait %s\n", i+1, t.Max, err, d)
+		tm := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			tm.Stop()
+			return err
+		case <-tm.C:
 		}
 	}
 	return err
 }
+
+// 重试也不会成功的错误：取消、本地文件不存在或无权限，以及后端明确拒绝的（认证、权限、
+// 不存在、空间不足、HTTP 4xx（408/429 除外）、FTP 5xx 等）；ErrTransient 和未分类的错误重试
+func noTry(err error) bool {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return true
+	case errors.Is(err, ErrTransient):
+		return false
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, fs.ErrPermission):
+		return true
+	}
+	var se *StoE
+	return errors.As(err, &se)
+}
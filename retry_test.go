@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"testing"
+	"time"
+)
+
+func TestWait(t *testing.T) {
+	tc := []Try{
+		{Max: 3, Base: 1000, Cap: 30000, Jit: 20},
+		{Max: 5, Base: 100, Cap: 1000, Jit: 100},
+		{Max: 5, Base: 500, Cap: 2000},
+	}
+	for _, p := range tc {
+		b := time.Duration(p.Base) * time.Millisecond
+		c := time.Duration(p.Cap) * time.Millisecond
+		j := float64(p.Jit) / 100
+		for i := 0; i < 10; i++ {
+			// 不浮动时的延迟
+			d := b
+			for k := 0; k < i && d < c; k++ {
+				d *= 2
+			}
+			lo := time.Duration(float64(d) * (1 - j))
+			hi := time.Duration(float64(d) * (1 + j))
+			for n := 0; n < 100; n++ {
+				w := p.wait(i)
+				if w > c || w > hi {
+					t.Fatalf("%+v wait(%d) = %s > min(%s, cap %s)", p, i, w, hi, c)
+				}
+				if w < lo && w < c {
+					t.Fatalf("%+v wait(%d) = %s < %s", p, i, w, lo)
+				}
+			}
+		}
+	}
+}
+
+func TestWaitNoJit(t *testing.T) {
+	p := Try{Max: 4, Base: 100, Cap: 500}
+	want := []time.Duration{100, 200, 400, 500, 500}
+	for i, w := range want {
+		if got := p.wait(i); got != w*time.Millisecond {
+			t.Errorf("wait(%d) = %s, want %s", i, got, w*time.Millisecond)
+		}
+	}
+}
+
+func TestSetTry(t *testing.T) {
+	old := tryP
+	defer func() { tryP = old }()
+
+	setTry(Try{Jit: -1})
+	if tryP.Jit != 0 || tryP.Max != old.Max {
+		t.Errorf("jit -1: %+v", tryP)
+	}
+	setTry(Try{Max: 7, Jit: 500})
+	if tryP.Max != 7 || tryP.Jit != 100 {
+		t.Errorf("max 7 jit 500: %+v", tryP)
+	}
+}
+
+func TestNoTry(t *testing.T) {
+	tc := []struct {
+		err error
+		no  bool
+	}{
+		{context.Canceled, true},
+		{fmt.Errorf("put: %w", context.Canceled), true},
+		{fs.ErrNotExist, true},
+		{fs.ErrPermission, true},
+		{io.ErrUnexpectedEOF, false},
+		{errors.New("plain"), false},
+		{&StoE{Op: "put", Err: errors.New("400 Bad Request")}, true},
+		{&StoE{Op: "put", K: ErrAuth, Err: errors.New("x")}, true},
+		{&StoE{Op: "put", K: ErrTransient, Err: errors.New("x")}, false},
+		{fmt.Errorf("wrap: %w", &StoE{Op: "put", K: ErrQuota, Err: errors.New("x")}), true},
+	}
+	for _, c := range tc {
+		if got := noTry(c.err); got != c.no {
+			t.Errorf("noTry(%v) = %v, want %v", c.err, got, c.no)
+		}
+	}
+}
+
+func TestDoTry(t *testing.T) {
+	old := tryP
+	defer func() { tryP = old }()
+	tryP = Try{Max: 3, Base: 1, Cap: 1}
+
+	n := 0
+	err := doTry(context.Background(), func() error {
+		n++
+		return io.ErrUnexpectedEOF
+	})
+	if n != 3 || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("transient: n=%d err=%v", n, err)
+	}
+
+	n = 0
+	err = doTry(context.Background(), func() error {
+		n++
+		return &StoE{Op: "put", K: ErrAuth, Err: errors.New("401")}
+	})
+	if n != 1 || !errors.Is(err, ErrAuth) {
+		t.Errorf("auth: n=%d err=%v", n, err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 远端报告名，每次覆盖为最近一次
+const rptF = "report.json"
+
+// 一个文件的处理结果，Act 为 upload/skip/pack/delete/plan/plan-delete/error
+type RptE struct {
+	L   string `json:"local,omitempty"`
+	R   string `json:"remote"`
+	Act string `json:"action"`
+	Err string `json:"error,omitempty"`
+}
+
+type RptJ struct {
+	Start  time.Time        `json:"start"`
+	End    time.Time        `json:"end"`
+	Sec    float64          `json:"seconds"`
+	Status string           `json:"status"` // ok/error/canceled
+	Fp     string           `json:"cfg_fp"`
+	Cfg    json.RawMessage  `json:"cfg"`
+	Tot    int64            `json:"total"`
+	Ok     int64            `json:"ok"`
+	Skp    int64            `json:"skip"`
+	Flt    int64            `json:"filtered"`
+	Del    int64            `json:"deleted"`
+	Err    int64            `json:"errors"`
+	Byt    int64            `json:"bytes"`
+	ErrK   map[string]int64 `json:"error_kinds,omitempty"`
+	Rc     int64            `json:"reconnects"`
+	Fail   []RptE           `json:"failures"`
+	Msg    []string         `json:"messages,omitempty"`
+	Files  []RptE           `json:"files,omitempty"`
+}
+
+// 本次运行的报告，nil 时不记录
+type Rpt struct {
+	mu  sync.Mutex
+	all bool
+	j   RptJ
+}
+
+// 指纹在快照改 root 之前取，同一份配置每次一样
+func mkRpt(cfg *Cfg) *Rpt {
+	if cfg.Rpt == "" {
+		return nil
+	}
+	r := &Rpt{all: cfg.RptAll}
+	r.j.Start = time.Now()
+	r.j.Cfg, r.j.Fp = cfgFp(cfg)
+	r.j.Fail = []RptE{}
+	return r
+}
+
+// 去掉密码和密钥后的配置及其 sha256
+func cfgFp(cfg *Cfg) (json.RawMessage, string) {
+	c := *cfg
+	if c.Pass != "" {
+		c.Pass = "***"
+	}
+	if c.Key != "" {
+		c.Key = "***"
+	}
+	if u, err := url.Parse(c.Url); err == nil {
+		c.Url = u.Redacted()
+	}
+	b, err := json.Marshal(&c)
+	if err != nil {
+		return nil, ""
+	}
+	h := sha256.Sum256(b)
+	return b, hex.EncodeToString(h[:])
+}
+
+// act 为空且无错误时不记
+func (r *Rpt) Add(l, rem, act string, err error) {
+	if r == nil || act == "" && err == nil {
+		return
+	}
+	e := RptE{L: l, R: rem, Act: act}
+	if err != nil {
+		e.Act, e.Err = "error", err.Error()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.j.Fail = append(r.j.Fail, e)
+	}
+	if r.all {
+		r.j.Files = append(r.j.Files, e)
+	}
+}
+
+// 不属于单个文件的错误，如遍历、清单、清理失败
+func (r *Rpt) Msg(s string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.j.Msg = append(r.j.Msg, s)
+	r.mu.Unlock()
+}
+
+// 写本地报告，配置了 report_up 时再传到 root/.wdbak/report.json；rerr 为 run 提前返回的错误
+func (r *Rpt) Done(ctx context.Context, cfg *Cfg, rs *Rs, dir string, rerr error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	j := &r.j
+	j.End = time.Now()
+	j.Sec = j.End.Sub(j.Start).Seconds()
+	j.Tot = atomic.LoadInt64(&stTot)
+	j.Ok = atomic.LoadInt64(&stOk)
+	j.Skp = atomic.LoadInt64(&stSkp)
+	j.Flt = atomic.LoadInt64(&stFlt)
+	j.Del = atomic.LoadInt64(&stDel)
+	j.Err = atomic.LoadInt64(&stErr)
+	j.Byt = atomic.LoadInt64(&stByt)
+	j.ErrK = kMap()
+	j.Rc = atomic.LoadInt64(&stRc)
+	switch {
+	case ctx.Err() != nil:
+		j.Status = "canceled"
+	case rerr != nil:
+		j.Msg = append(j.Msg, rerr.Error())
+		j.Status = "error"
+	case j.Err > 0 || len(j.Msg) > 0:
+		j.Status = "error"
+	default:
+		j.Status = "ok"
+	}
+	b, err := json.MarshalIndent(j, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		log.Printf("[ERR] report: %v\n", err)
+		return
+	}
+
+	p := cfg.Rpt
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(dir, p)
+	}
+	if err := wrF(p, b); err != nil {
+		log.Printf("[ERR] report %s: %v\n", p, err)
+	} else {
+		log.Printf("report=%s\n", p)
+	}
+
+	if !cfg.RptUp || cfg.Dry || ctx.Err() != nil {
+		return
+	}
+	sto, err := mkSto(cfg)
+	if err != nil {
+		log.Printf("[ERR] report upload: %v\n", err)
+		return
+	}
+	defer sto.Cls()
+	rem := remP(cfg, ctlDir+"/"+rptF)
+	if err := putB(ctx, sto, rs.dc, rem, b); err != nil {
+		log.Printf("[ERR] report upload %s: %v\n", rem, err)
+	}
+}
+
+// 先写临时文件再改名，监控读到的不会是半个文件
+func wrF(p string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// 支持断点续传的后端实现，src.R 已定位到 off，src.Sz 为文件总大小
+type Rsm interface {
+	PutAt(ctx context.Context, src *Src, rem string, off int64) error
+}
+
+// 服务器不支持续传，调用方改为整传
+var errNoRsm = errors.New("resume not supported")
+
+// 本地文件指纹：大小 + 修改时间 + 头尾各 1MB 的哈希
+type Fp struct {
+	Sz int64
+	Mt int64
+	Hs string
+}
+
+const fpBlk = 1 << 20
+
+func mkFp(f *os.File, st os.FileInfo) (Fp, error) {
+	h := sha1.New()
+	buf := make([]byte, fpBlk)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return Fp{}, err
+	}
+	h.Write(buf[:n])
+	if st.Size() > 2*fpBlk {
+		n, err = f.ReadAt(buf, st.Size()-fpBlk)
+		if err != nil && err != io.EOF {
+			return Fp{}, err
+		}
+		h.Write(buf[:n])
+	}
+	return Fp{
+		Sz: st.Size(),
+		Mt: st.ModTime().UnixNano(),
+		Hs: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// 续传日志，记录正在上传的大文件指纹，每次变更都落盘以便下次运行接着传
+type Pj struct {
+	mu sync.Mutex
+	p  string
+	m  map[string]Fp
+}
+
+func opPj(p string) (*Pj, error) {
+	j := &Pj{p: p, m: make(map[string]Fp)}
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return j, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	if err := gob.NewDecoder(f).Decode(&j.m); err != nil {
+		log.Printf("[WRN] resume %s: %v\n", p, err)
+		j.m = make(map[string]Fp)
+	}
+	return j, nil
+}
+
+func (j *Pj) Get(rem string) (Fp, bool) {
+	if j == nil {
+		return Fp{}, false
+	}
+	j.mu.Lock()
+	fp, ok := j.m[rem]
+	j.mu.Unlock()
+	return fp, ok
+}
+
+func (j *Pj) Set(rem string, fp Fp) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if old, ok := j.m[rem]; ok && old == fp {
+		return
+	}
+	j.m[rem] = fp
+	j.save()
+}
+
+func (j *Pj) Del(rem string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.m[rem]; !ok {
+		return
+	}
+	delete(j.m, rem)
+	j.save()
+}
+
+func (j *Pj) save() {
+	tmp := j.p + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		log.Printf("[WRN] resume save: %v\n", err)
+		return
+	}
+	err = gob.NewEncoder(f).Encode(j.m)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.p)
+	}
+	if err != nil {
+		log.Printf("[WRN] resume save: %v\n", err)
+	}
+}
+
+// 指纹一致且远端是未传完的同名文件时返回续传偏移
+func rsmOff(ctx context.Context, sto Sto, pj *Pj, rem string, fp Fp) (int64, error) {
+	if _, ok := sto.(Rsm); !ok {
+		return 0, nil
+	}
+	old, ok := pj.Get(rem)
+	if !ok || old != fp {
+		return 0, nil
+	}
+	e, err := sto.Stat(ctx, rem)
+	if err != nil {
+		return 0, fmt.Errorf("stat %s: %w", rem, err)
+	}
+	if e == nil || e.Dir || e.Sz <= 0 || e.Sz >= fp.Sz {
+		return 0, nil
+	}
+	return e.Sz, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 恢复选项
+type rstO struct {
+	skp bool // 本地已存在时跳过
+	tst bool // 只下载、解密、解压检查，不写本地
+	ek  *Ek
+}
+
+// WDBak restore [-mode over|skip] <远端路径> <本地目录>
+// WDBak restore -test <远端路径>
+// 远端路径相对 root，为空或 / 时恢复整个 root
+func restore(ctx context.Context, cfg *Cfg, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	mode := fs.String("mode", "skip", "over|skip for existing local files")
+	tst := fs.Bool("test", false, "download, decrypt and decompress without writing")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if n := fs.NArg(); n != 2 && !(*tst && n == 1) {
+		return fmt.Errorf("use: WDBak restore [-mode over|skip] <remote> <local> | restore -test <remote>")
+	}
+	if *mode != "over" && *mode != "skip" {
+		return fmt.Errorf("restore mode bad: %s", *mode)
+	}
+	o := &rstO{skp: *mode == "skip" && !*tst, tst: *tst, ek: cfg.ek}
+	src := strings.Trim(remP(cfg, strings.Trim(fs.Arg(0), "/")), "/")
+	dst := ""
+	if !*tst {
+		d, err := filepath.Abs(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		dst = d
+	}
+
+	sto, err := mkSto(cfg)
+	if err != nil {
+		return err
+	}
+	defer sto.Cls()
+
+	e, err := sto.Stat(ctx, src)
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", src, err)
+	}
+	// 不存在时可能是打包卷里的文件
+	var es []*Ent
+	one := e != nil && !e.Dir
+	if one {
+		e.P = src
+		es = []*Ent{e}
+		src = path.Dir(src)
+	} else {
+		// 有的服务器 Stat 认不出目录（没有 MLST 的 FTP），不存在时再列一下
+		if es, err = sto.Ls(ctx, src, true); err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("ls %s: %w", src, err)
+		}
+	}
+	log.Printf("restore %s -> %s files=%d mode=%s\n", src, dst, len(es), *mode)
+
+	q := make(chan Job, cfg.Thr*4)
+	wg := pool(ctx, cfg, q, func(sto Sto, j Job) error {
+		return getOne(ctx, sto, j, o)
+	})
+
+	have := make(map[string]time.Time)
+	for _, e := range es {
+		if ctx.Err() != nil {
+			break
+		}
+		if e.Dir {
+			continue
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(e.P, src), "/")
+		if isCtl(rel) {
+			continue
+		}
+		k := strings.TrimSuffix(rel, encSuf)
+		have[k] = e.Mt
+		have[strings.TrimSuffix(k, zipSuf)] = e.Mt
+		lp, err := locP(dst, rel)
+		if err != nil {
+			atomic.AddInt64(&stErr, 1)
+			log.Printf("[ERR] %v\n", err)
+			continue
+		}
+		select {
+		case q <- Job{L: lp, R: e.P, Mt: e.Mt}:
+		case <-ctx.Done():
+		}
+	}
+	close(q)
+	wg.Wait()
+
+	if !one && ctx.Err() == nil {
+		if err := rstPk(ctx, sto, cfg, src, dst, o, have); err != nil {
+			atomic.AddInt64(&stErr, 1)
+			log.Printf("[ERR] pack: %v\n", err)
+		}
+		if e == nil && src != "" && atomic.LoadInt64(&stTot) == 0 {
+			return fmt.Errorf("remote %s not found", src)
+		}
+	}
+
+	// 单个文件不恢复链接
+	if !one && !*tst && ctx.Err() == nil {
+		if err := rstSym(ctx, sto, cfg, src, dst, o.skp); err != nil {
+			atomic.AddInt64(&stErr, 1)
+			log.Printf("[ERR] sym: %v\n", err)
+		}
+	}
+
+	log.Printf("tot=%d ok=%d skip=%d err=%d sym=%d\n",
+		atomic.LoadInt64(&stTot),
+		atomic.LoadInt64(&stOk),
+		atomic.LoadInt64(&stSkp),
+		atomic.LoadInt64(&stErr),
+		atomic.LoadInt64(&stLnk),
+	)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// 远端相对路径转本地路径，不允许跳出目标目录
+func locP(dst, rel string) (string, error) {
+	for _, s := range strings.Split(rel, "/") {
+		if s == ".." {
+			return "", fmt.Errorf("bad remote path: %s", rel)
+		}
+	}
+	return filepath.Join(dst, filepath.FromSlash(rel)), nil
+}
+
+// 下载一个文件，先写临时文件再改名，避免留下半个文件
+// 加密的先解密，本程序压缩上传的 .gz 再解压，去掉对应后缀
+func getOne(ctx context.Context, sto Sto, j Job, o *rstO) error {
+	atomic.AddInt64(&stTot, 1)
+	x := strings.HasSuffix(j.R, encSuf)
+	if x && o.ek == nil {
+		return fmt.Errorf("get %s: encrypted, key not set", j.R)
+	}
+	base := strings.TrimSuffix(j.L, encSuf)
+	if !x {
+		base = j.L
+	}
+	z := strings.HasSuffix(base, zipSuf)
+	if o.skp {
+		_, err := os.Stat(base)
+		if err != nil && z {
+			_, err = os.Stat(strings.TrimSuffix(base, zipSuf))
+		}
+		if err == nil {
+			atomic.AddInt64(&stSkp, 1)
+			log.Printf("[SKIP] %s -> %s\n", j.R, base)
+			return nil
+		}
+	}
+	if !o.tst {
+		if err := os.MkdirAll(filepath.Dir(j.L), 0o755); err != nil {
+			return err
+		}
+	}
+
+	lp, mt := base, j.Mt
+	err := doTry(ctx, func() error {
+		rc, err := sto.Get(ctx, j.R)
+		if err != nil {
+			return fmt.Errorf("get %s: %w", j.R, err)
+		}
+		tmp := ""
+		err = func() error {
+			var r io.Reader = rc
+			lp, mt = base, j.Mt
+			if x {
+				var err error
+				if r, err = newDecR(r, o.ek); err != nil {
+					return err
+				}
+			}
+			if z {
+				var zmt time.Time
+				var ok bool
+				if r, zmt, ok = unZip(r); ok {
+					lp = strings.TrimSuffix(base, zipSuf)
+					if !zmt.IsZero() {
+						mt = zmt
+					}
+				}
+			}
+			if o.tst {
+				_, err := io.Copy(io.Discard, r)
+				return err
+			}
+			tmp = lp + ".wdbak.tmp"
+			f, err := os.Create(tmp)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, r)
+			if e := f.Close(); err == nil {
+				err = e
+			}
+			return err
+		}()
+		// 只关一次，FTP 关闭时读结束应答，出错说明没传完
+		if e := rc.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			if tmp != "" {
+				os.Remove(tmp)
+			}
+			return fmt.Errorf("get %s: %w", j.R, err)
+		}
+		if o.tst {
+			return nil
+		}
+		return os.Rename(tmp, lp)
+	})
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&stOk, 1)
+	if o.tst {
+		dbgLogf("[OK ] %s\n", j.R)
+		return nil
+	}
+	if !mt.IsZero() {
+		_ = os.Chtimes(lp, mt, mt)
+	}
+	dbgLogf("[OK ] %s -> %s\n", j.R, lp)
+	return nil
+}
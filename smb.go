@@ -2,23 +2,41 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/url"
 	"os"
 	"path"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/hirochachacha/go-smb2"
 )
 
+// 单个 worker 连续重连次数上限（操作成功后清零），每次断线最多连试 3 次
+const (
+	smbMaxRe = 10
+	smbTry   = 3
+)
+
+// 连接、会话或挂载断开后整套重建，再把正在做的操作重做一次
 type SmbSto struct {
 	fs   *smb2.Share
 	ses  *smb2.Session
 	con  net.Conn
+	host string
+	unc  string
+	usr  string
+	pas  string
 	root string
+	bad  bool // 会话已断，下次操作前重连
+	nre  int  // 上次操作成功以来尝试重连的次数
+	lim  *Lim
+	meta Sem
 }
 
 func newSmb(cfg *Cfg) (Sto, error) {
@@ -26,40 +44,62 @@ func newSmb(cfg *Cfg) (Sto, error) {
 	if err != nil {
 		return nil, err
 	}
+	s := &SmbSto{
+		host: host,
+		unc:  `\\` + host + `\` + sh,
+		usr:  cfg.User,
+		pas:  cfg.Pass,
+		root: strings.Trim(base, "/"),
+		lim:  cfg.lim,
+		meta: cfg.meta,
+	}
+	if err := s.dial(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
 
-	conn, err := net.Dial("tcp", net.JoinHostPort(host, "445"))
+func (s *SmbSto) dial() error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(s.host, "445"), 30*time.Second)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	d := &smb2.Dialer{
 		Initiator: &smb2.NTLMInitiator{
-			User:     cfg.User,
-			Password: cfg.Pass,
+			User:     s.usr,
+			Password: s.pas,
 		},
 	}
 
 	ses, err := d.Dial(conn)
 	if err != nil {
 		conn.Close()
-		return nil, err
+		return smbE("login", s.host, err)
 	}
 
-	unc := `\\` + host + `\` + sh
-	fs, err := ses.Mount(unc)
+	fs, err := ses.Mount(s.unc)
 	if err != nil {
 		ses.Logoff()
 		conn.Close()
-		return nil, err
+		return smbE("mount", s.unc, err)
 	}
+	s.fs, s.ses, s.con, s.bad = fs, ses, conn, false
+	return nil
+}
 
-	r := strings.Trim(base, "/")
-	return &SmbSto{
-		fs:   fs,
-		ses:  ses,
-		con:  conn,
-		root: r,
-	}, nil
+// 先关 TCP，已断的会话上 Umount/Logoff 会立即失败而不是等超时
+func (s *SmbSto) drop() {
+	if s.con != nil {
+		_ = s.con.Close()
+	}
+	if s.fs != nil {
+		_ = s.fs.Umount()
+	}
+	if s.ses != nil {
+		_ = s.ses.Logoff()
+	}
+	s.fs, s.ses, s.con = nil, nil, nil
 }
 
 func (s *SmbSto) Cls() {
@@ -74,6 +114,83 @@ func (s *SmbSto) Cls() {
 	}
 }
 
+// 传输层错误和会话失效说明要重连
+func smbDead(err error) bool {
+	return errors.Is(smbE("", "", err), ErrTransient) || netK(err) != nil
+}
+
+// 重建连接，认证失败等不可重试的错误或到达上限时放弃
+func (s *SmbSto) re(ctx context.Context) error {
+	s.drop()
+	s.bad = true
+	var err error
+	for i := 0; i < smbTry; i++ {
+		if s.nre >= smbMaxRe {
+			return &StoE{Op: "reconnect", P: s.host, Err: fmt.Errorf("limit %d reached", smbMaxRe)}
+		}
+		s.nre++
+		if err = s.dial(); err == nil {
+			atomic.AddInt64(&stRc, 1)
+			log.Printf("[WRN] smb reconnected %s (%d/%d)\n", s.host, s.nre, smbMaxRe)
+			return nil
+		}
+		log.Printf("[WRN] smb reconnect %s: %v\n", s.host, err)
+		if noTry(err) {
+			return err
+		}
+		t := time.NewTimer(time.Duration(1<<i) * time.Second)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return err
+}
+
+// 执行 fn，会话断了先重连；fn 因断线失败时重连，again 为 true 时重做一次。
+// 上传的数据已读掉不能重做，交给调用方的 doTry；重连过仍失败的错误里注明。ctx 取消后不再重连
+func (s *SmbSto) do(ctx context.Context, again bool, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	n0 := s.nre
+	if s.bad {
+		if err := s.re(ctx); err != nil {
+			return err
+		}
+	}
+	err := fn()
+	if err != nil && ctx.Err() != nil {
+		// 取消时文件句柄关不掉，断开会话让服务器释放，下次操作前重连。
+		// go-smb2 的 ContextError 不能用 errors.Is 判断
+		s.drop()
+		s.bad = true
+		if !errors.Is(err, ctx.Err()) {
+			err = fmt.Errorf("%v: %w", err, ctx.Err())
+		}
+		return err
+	}
+	if err != nil && smbDead(err) {
+		dbgLogf("[SMB] %s: session lost: %v\n", s.host, err)
+		if e := s.re(ctx); e == nil && again {
+			if err = fn(); err != nil && smbDead(err) {
+				s.bad = true
+			}
+		}
+	}
+	rc := s.nre > n0
+	// 服务器有应答说明会话可用，重连计数清零
+	if err == nil || !smbDead(err) {
+		s.nre = 0
+	}
+	if err != nil && rc {
+		return fmt.Errorf("%w (after smb reconnect)", err)
+	}
+	return err
+}
+
 func (s *SmbSto) full(rem string) string {
 	if s.root == "" {
 		return rem
@@ -85,61 +202,261 @@ func (s *SmbSto) Mk(ctx context.Context, dir string) error {
 	if dir == "" {
 		return nil
 	}
-	p := s.full(dir)
-	if err := s.fs.MkdirAll(p, 0777); err != nil {
-		if os.IsExist(err) {
-			return nil
-		}
+	if err := s.meta.Get(ctx); err != nil {
 		return err
 	}
-	return nil
+	defer s.meta.Put()
+	p := s.full(dir)
+	return s.do(ctx, true, func() error {
+		if err := smbE("mkdir", p, s.fs.MkdirAll(p, 0777)); err != nil && !errors.Is(err, ErrExists) {
+			return err
+		}
+		return nil
+	})
 }
 
 func (s *SmbSto) Has(ctx context.Context, rem string) (bool, error) {
-	p := s.full(rem)
-	f, err := s.fs.Open(p)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return false, nil
-		}
+	if err := s.meta.Get(ctx); err != nil {
 		return false, err
 	}
-	f.Close()
-	return true, nil
+	defer s.meta.Put()
+	p := s.full(rem)
+	ok := false
+	err := s.do(ctx, true, func() error {
+		f, err := s.fs.Open(p)
+		if err != nil {
+			if err = smbE("open", p, err); errors.Is(err, ErrNotFound) {
+				ok = false
+				return nil
+			}
+			return err
+		}
+		f.Close()
+		ok = true
+		return nil
+	})
+	return ok, err
 }
 
-func (s *SmbSto) Put(ctx context.Context, loc, rem string, sz int64) error {
+func (s *SmbSto) Stat(ctx context.Context, rem string) (*Ent, error) {
+	if err := s.meta.Get(ctx); err != nil {
+		return nil, err
+	}
+	defer s.meta.Put()
 	p := s.full(rem)
-	dbgLogf("[DBG] PUT %s -> smb:%s (%d bytes)", loc, p, sz)
-	return doTry(ctx, 3, func() error {
-		in, err := os.Open(loc)
+	var out *Ent
+	err := s.do(ctx, true, func() error {
+		out = nil
+		st, err := s.fs.Stat(p)
 		if err != nil {
+			if err = smbE("stat", p, err); errors.Is(err, ErrNotFound) {
+				return nil
+			}
 			return err
 		}
-		defer in.Close()
+		out = &Ent{
+			P:   rem,
+			Sz:  st.Size(),
+			Mt:  st.ModTime(),
+			Dir: st.IsDir(),
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (s *SmbSto) Ls(ctx context.Context, dir string, deep bool) ([]*Ent, error) {
+	var out []*Ent
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		fis, err := s.fs.ReadDir(s.full(dir))
+		if err != nil {
+			return smbE("readdir", s.full(dir), err)
+		}
+		for _, fi := range fis {
+			p := path.Join(dir, fi.Name())
+			out = append(out, &Ent{
+				P:   p,
+				Sz:  fi.Size(),
+				Mt:  fi.ModTime(),
+				Dir: fi.IsDir(),
+			})
+			if fi.IsDir() && deep {
+				if err := walk(p); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	err := s.do(ctx, true, func() error {
+		out = nil
+		return walk(strings.Trim(dir, "/"))
+	})
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+func (s *SmbSto) Put(ctx context.Context, src *Src, rem string) error {
+	p := s.full(rem)
+	dbgLogf("[DBG] PUT %s -> smb:%s (%d bytes)", src.L, p, src.Sz)
 
-		out, err := s.fs.Create(p)
+	t0 := time.Now()
+	var n int64
+	made := false
+	err := s.do(ctx, false, func() error {
+		// 文件上的读写也带着 ctx，取消时不等网络
+		out, err := s.fs.WithContext(ctx).Create(p)
 		if err != nil {
-			return err
+			return smbE("create", p, err)
 		}
+		made = true
 		defer out.Close()
 
-		t0 := time.Now()
-		n, err := io.Copy(out, in)
-		if err != nil {
+		if n, err = io.Copy(out, s.lim.R(ctx, &ctxR{ctx: ctx, r: src.R})); err != nil {
+			return smbE("write", p, err)
+		}
+		if err := out.Close(); err != nil {
+			return smbE("close", p, err)
+		}
+		if !src.Mt.IsZero() {
+			_ = s.fs.Chtimes(p, src.Mt, src.Mt)
+		}
+		return nil
+	})
+	if err != nil {
+		// Create 已截断或新建了远端文件，留着会被当成已传完；可续传的留着
+		if made && !src.Rsm {
+			err = rmPart(s, rem, err)
+		}
+		return err
+	}
+
+	dur := time.Since(t0).Seconds()
+	if dur <= 0 {
+		dur = 0.001
+	}
+	mb := float64(n) / 1024.0 / 1024.0
+	spd := mb / dur
+	dbgLogf("[OK ] %s -> smb:%s (%.2f MB, %.1fs, %.2f MB/s)\n",
+		src.L, p, mb, dur, spd)
+	return nil
+}
+
+func (s *SmbSto) Get(ctx context.Context, rem string) (io.ReadCloser, error) {
+	var f *smb2.File
+	err := s.do(ctx, true, func() error {
+		var err error
+		if f, err = s.fs.WithContext(ctx).Open(s.full(rem)); err != nil {
+			return smbE("open", s.full(rem), err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *SmbSto) Del(ctx context.Context, rem string, dir bool) error {
+	p := s.full(rem)
+	return s.do(ctx, true, func() error {
+		var err error
+		if dir {
+			err = s.fs.RemoveAll(p)
+		} else {
+			err = s.fs.Remove(p)
+		}
+		if err = smbE("remove", p, err); err != nil && !errors.Is(err, ErrNotFound) {
 			return err
 		}
+		return nil
+	})
+}
+
+// 打开已有远端文件，定位到已传大小后接着写
+func (s *SmbSto) PutAt(ctx context.Context, src *Src, rem string, off int64) error {
+	p := s.full(rem)
+	dbgLogf("[DBG] PUT %s -> smb:%s (%d/%d bytes)", src.L, p, src.Sz-off, src.Sz)
+
+	err := s.do(ctx, false, func() error {
+		out, err := s.fs.WithContext(ctx).OpenFile(p, os.O_WRONLY, 0666)
+		if err != nil {
+			return smbE("open", p, err)
+		}
+		defer out.Close()
 
-		dur := time.Since(t0).Seconds()
-		if dur <= 0 {
-			dur = 0.001
+		if _, err := out.Seek(off, io.SeekStart); err != nil {
+			return smbE("seek", p, err)
+		}
+		if _, err := io.Copy(out, s.lim.R(ctx, &ctxR{ctx: ctx, r: src.R})); err != nil {
+			return smbE("write", p, err)
+		}
+		if err := out.Close(); err != nil {
+			return smbE("close", p, err)
+		}
+		if !src.Mt.IsZero() {
+			_ = s.fs.Chtimes(p, src.Mt, src.Mt)
 		}
-		mb := float64(n) / 1024.0 / 1024.0
-		spd := mb / dur
-		dbgLogf("[OK ] %s -> smb:%s (%.2f MB, %.1fs, %.2f MB/s)\n",
-			loc, p, mb, dur, spd)
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	dbgLogf("[OK ] %s -> smb:%s (resumed @%d)\n", src.L, p, off)
+	return nil
+}
+
+// 按 NTSTATUS 分类，go-smb2 已转成 os.ErrNotExist 等的也归类；其他原样返回
+func smbE(op, p string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var k error
+	var re *smb2.ResponseError
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		k = ErrNotFound
+	case errors.Is(err, os.ErrExist):
+		k = ErrExists
+	case errors.Is(err, os.ErrPermission):
+		k = ErrPermission
+	case errors.As(err, &re):
+		switch re.Code {
+		case 0xC000006D, // LOGON_FAILURE
+			0xC0000064, // NO_SUCH_USER
+			0xC000006A, // WRONG_PASSWORD
+			0xC0000071, // PASSWORD_EXPIRED
+			0xC0000072: // ACCOUNT_DISABLED
+			k = ErrAuth
+		case 0xC000007F, // DISK_FULL
+			0xC0000044: // QUOTA_EXCEEDED
+			k = ErrQuota
+		case 0xC00000CC: // BAD_NETWORK_NAME
+			k = ErrNotFound
+		case 0xC00000C9, // NETWORK_NAME_DELETED
+			0xC0000203, // USER_SESSION_DELETED
+			0xC000035C: // NETWORK_SESSION_EXPIRED
+			k = ErrTransient
+		default:
+			return err
+		}
+	default:
+		var te *smb2.TransportError
+		if !errors.As(err, &te) {
+			return err
+		}
+		k = ErrTransient
+	}
+	return &StoE{Op: op, P: p, K: k, Err: err}
 }
 
 func prsSmb(su string) (host, sh, base string, err error) {
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+func TestSmbE(t *testing.T) {
+	tc := []struct {
+		err error
+		k   error
+		no  bool
+	}{
+		{&smb2.ResponseError{Code: 0xC000006D}, ErrAuth, true},
+		{&smb2.ResponseError{Code: 0xC0000064}, ErrAuth, true},
+		{&smb2.ResponseError{Code: 0xC000006A}, ErrAuth, true},
+		{&smb2.ResponseError{Code: 0xC0000071}, ErrAuth, true},
+		{&smb2.ResponseError{Code: 0xC0000072}, ErrAuth, true},
+		{&smb2.ResponseError{Code: 0xC000007F}, ErrQuota, true},
+		{&smb2.ResponseError{Code: 0xC0000044}, ErrQuota, true},
+		{&smb2.ResponseError{Code: 0xC00000CC}, ErrNotFound, true},
+		{&smb2.ResponseError{Code: 0xC00000C9}, ErrTransient, false},
+		{&smb2.ResponseError{Code: 0xC0000203}, ErrTransient, false},
+		{&smb2.ResponseError{Code: 0xC000035C}, ErrTransient, false},
+		{&smb2.TransportError{Err: errors.New("closed")}, ErrTransient, false},
+		{&os.PathError{Op: "open", Path: "a", Err: os.ErrNotExist}, ErrNotFound, true},
+		{&os.PathError{Op: "open", Path: "a", Err: os.ErrExist}, ErrExists, true},
+		{&os.PathError{Op: "open", Path: "a", Err: os.ErrPermission}, ErrPermission, true},
+	}
+	for _, c := range tc {
+		err := smbE("open", "a", c.err)
+		var se *StoE
+		if !errors.As(err, &se) {
+			t.Fatalf("%v: %v is not *StoE", c.err, err)
+		}
+		if se.K != c.k {
+			t.Errorf("%v: kind %v, want %v", c.err, se.K, c.k)
+		}
+		if got := noTry(err); got != c.no {
+			t.Errorf("%v: noTry %v, want %v", c.err, got, c.no)
+		}
+	}
+
+	// 未知的 NTSTATUS 原样返回
+	e := &smb2.ResponseError{Code: 0xC0000022 + 1}
+	if got := smbE("open", "a", e); got != error(e) {
+		t.Errorf("unknown status: %v", got)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const defSnapFmt = "20060102-150405"
+
+// 保留策略，全为 0 时不清理
+type Keep struct {
+	Last int `json:"last"`
+	Day  int `json:"day"`
+	Week int `json:"week"`
+}
+
+type snap struct {
+	name string
+	t    time.Time
+	seq  int // 同名时加的序号，没有为 0
+}
+
+// 本次快照目录名
+func snapName(cfg *Cfg, now time.Time) string {
+	f := cfg.SnapFmt
+	if f == "" {
+		f = defSnapFmt
+	}
+	return now.Format(f)
+}
+
+// 同一秒运行两次或格式精度较粗时目录名会重复，已存在时加 _2、_3… 后缀
+func snapUniq(ctx context.Context, cfg *Cfg, base, n string) (string, error) {
+	sto, err := mkSto(cfg)
+	if err != nil {
+		return "", err
+	}
+	defer sto.Cls()
+	for i := 1; ; i++ {
+		c := n
+		if i > 1 {
+			c = fmt.Sprintf("%s_%d", n, i)
+		}
+		e, err := sto.Stat(ctx, path.Join(base, c))
+		if err != nil {
+			return "", fmt.Errorf("stat %s: %w", path.Join(base, c), err)
+		}
+		if e == nil {
+			return c, nil
+		}
+	}
+}
+
+// 解析快照目录名，带 _N 序号的去掉序号再解析
+func prsSnap(f, n string) (snap, bool) {
+	if t, err := time.ParseInLocation(f, n, time.Local); err == nil {
+		return snap{name: n, t: t}, true
+	}
+	i := strings.LastIndexByte(n, '_')
+	if i <= 0 {
+		return snap{}, false
+	}
+	seq, err := strconv.Atoi(n[i+1:])
+	if err != nil || seq < 2 {
+		return snap{}, false
+	}
+	t, err := time.ParseInLocation(f, n[:i], time.Local)
+	if err != nil {
+		return snap{}, false
+	}
+	return snap{name: n, t: t, seq: seq}, true
+}
+
+// 按保留策略算出要删的快照：最近 N 个、最近 D 天每天最新一个、最近 W 周每周最新一个
+func pruneSet(ss []snap, k Keep, cur string) []snap {
+	sort.Slice(ss, func(i, j int) bool {
+		if ss[i].t.Equal(ss[j].t) {
+			return ss[i].seq > ss[j].seq
+		}
+		return ss[i].t.After(ss[j].t)
+	})
+
+	keep := make(map[string]bool)
+	keep[cur] = true
+	for i := 0; i < len(ss) && i < k.Last; i++ {
+		keep[ss[i].name] = true
+	}
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	for _, s := range ss {
+		d := s.t.Format("2006-01-02")
+		if !days[d] && len(days) < k.Day {
+			days[d] = true
+			keep[s.name] = true
+		}
+		y, w := s.t.ISOWeek()
+		wk := fmt.Sprintf("%d-%02d", y, w)
+		if !weeks[wk] && len(weeks) < k.Week {
+			weeks[wk] = true
+			keep[s.name] = true
+		}
+	}
+
+	var del []snap
+	for _, s := range ss {
+		if !keep[s.name] {
+			del = append(del, s)
+		}
+	}
+	return del
+}
+
+// 清理 base 下的旧快照，目录名解析不出时间的不动
+func prune(ctx context.Context, cfg *Cfg, base, cur string) error {
+	k := cfg.Keep
+	if k.Last <= 0 && k.Day <= 0 && k.Week <= 0 {
+		return nil
+	}
+	f := cfg.SnapFmt
+	if f == "" {
+		f = defSnapFmt
+	}
+
+	sto, err := mkSto(cfg)
+	if err != nil {
+		return err
+	}
+	defer sto.Cls()
+
+	es, err := sto.Ls(ctx, base, false)
+	if err != nil {
+		return fmt.Errorf("ls %s: %w", base, err)
+	}
+	var ss []snap
+	for _, e := range es {
+		if !e.Dir {
+			continue
+		}
+		if s, ok := prsSnap(f, path.Base(e.P)); ok {
+			ss = append(ss, s)
+		}
+	}
+
+	for _, s := range pruneSet(ss, k, cur) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		p := path.Join(base, s.name)
+		if cfg.Dry {
+			atomic.AddInt64(&stDel, 1)
+			log.Printf("[PLAN] prune %s\n", p)
+			continue
+		}
+		if err := sto.Del(ctx, p, true); err != nil {
+			return fmt.Errorf("del %s: %w", p, err)
+		}
+		atomic.AddInt64(&stDel, 1)
+		log.Printf("[PRUNE] %s\n", p)
+	}
+	return nil
+}
+
+// 快照格式只能是一级目录名
+func ckSnap(f string) error {
+	if f == "" {
+		return nil
+	}
+	if strings.ContainsAny(f, `/\`) {
+		return fmt.Errorf("snap_fmt %q: must not contain /", f)
+	}
+	n := time.Now().Format(f)
+	if _, err := time.ParseInLocation(f, n, time.Local); err != nil {
+		return fmt.Errorf("snap_fmt %q: %w", f, err)
+	}
+	if n == f {
+		return fmt.Errorf("snap_fmt %q: no time field", f)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPrsSnap(t *testing.T) {
+	tc := []struct {
+		n   string
+		ok  bool
+		seq int
+	}{
+		{"20260101-120000", true, 0},
+		{"20260101-120000_2", true, 2},
+		{"20260101-120000_12", true, 12},
+		{"20260101-120000_1", false, 0},
+		{"20260101-120000_x", false, 0},
+		{"other", false, 0},
+	}
+	for _, c := range tc {
+		s, ok := prsSnap(defSnapFmt, c.n)
+		if ok != c.ok || s.seq != c.seq {
+			t.Errorf("%s: ok=%v seq=%d, want %v %d", c.n, ok, s.seq, c.ok, c.seq)
+		}
+	}
+}
+
+// 同一秒的快照按序号区分新旧，last=2 时只删最早的
+func TestPruneSameSecond(t *testing.T) {
+	var ss []snap
+	for _, n := range []string{"20260101-120000", "20260101-120000_3", "20260101-120000_2"} {
+		s, ok := prsSnap(defSnapFmt, n)
+		if !ok {
+			t.Fatal(n)
+		}
+		ss = append(ss, s)
+	}
+	del := pruneSet(ss, Keep{Last: 2}, "20260101-120000_3")
+	if len(del) != 1 || del[0].name != "20260101-120000" {
+		t.Errorf("del = %+v", del)
+	}
+}
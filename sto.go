@@ -2,16 +2,232 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// 后端把协议错误映射到这些，调用方用 errors.Is 判断
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrAuth       = errors.New("auth failed")
+	ErrPermission = errors.New("permission denied")
+	ErrQuota      = errors.New("quota exceeded")
+	ErrTransient  = errors.New("transient")
+	ErrExists     = errors.New("already exists")
+)
+
+// 已分类的后端错误，K 为上面之一，nil 表示服务器明确拒绝但不属于这几类
+type StoE struct {
+	Op  string
+	P   string
+	K   error
+	Err error
+}
+
+func (e *StoE) Error() string {
+	if e.P == "" {
+		return fmt.Sprintf("%s: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("%s %s: %v", e.Op, e.P, e.Err)
+}
+
+func (e *StoE) Unwrap() []error {
+	if e.K == nil {
+		return []error{e.Err}
+	}
+	return []error{e.K, e.Err}
+}
+
+// 连接断开、超时等网络错误归为 ErrTransient，其他返回 nil
+func netK(err error) error {
+	var ne net.Error
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	if errors.As(err, &ne) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return ErrTransient
+	}
+	return nil
+}
+
+// 汇总里按类计数的名字
+func errKind(err error) string {
+	switch {
+	case errors.Is(err, ErrAuth):
+		return "auth"
+	case errors.Is(err, ErrPermission), errors.Is(err, os.ErrPermission):
+		return "perm"
+	case errors.Is(err, ErrQuota):
+		return "quota"
+	case errors.Is(err, ErrNotFound), errors.Is(err, os.ErrNotExist):
+		return "notfound"
+	case errors.Is(err, ErrExists):
+		return "exists"
+	case errors.Is(err, ErrTransient), netK(err) != nil:
+		return "transient"
+	}
+	return "other"
+}
+
+// 每类错误的文件数
+var stK = struct {
+	mu sync.Mutex
+	m  map[string]int64
+}{m: make(map[string]int64)}
+
+func addK(err error) {
+	stK.mu.Lock()
+	stK.m[errKind(err)]++
+	stK.mu.Unlock()
+}
+
+func kMap() map[string]int64 {
+	stK.mu.Lock()
+	defer stK.mu.Unlock()
+	m := make(map[string]int64, len(stK.m))
+	for k, n := range stK.m {
+		m[k] = n
+	}
+	return m
+}
+
+// 按固定顺序拼成 auth=1 transient=2，没有错误时为空
+func kSum() string {
+	m := kMap()
+	var b strings.Builder
+	for _, k := range []string{"auth", "perm", "quota", "notfound", "exists", "transient", "other"} {
+		if m[k] == 0 {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%s=%d", k, m[k])
+	}
+	return b.String()
+}
+
 type Sto interface {
-	Put(ctx context.Context, loc, rem string, sz int64) error
+	// 只传一次，重试由调用方负责
+	Put(ctx context.Context, src *Src, rem string) error
 	Has(ctx context.Context, rem string) (bool, error)
+	// 不存在时返回 nil, nil
+	Stat(ctx context.Context, rem string) (*Ent, error)
+	// 列出 dir 下的文件和目录，deep 为 true 时递归，P 为不带前导 / 的远端路径
+	Ls(ctx context.Context, dir string, deep bool) ([]*Ent, error)
+	// 读取远端文件，调用方负责 Close
+	Get(ctx context.Context, rem string) (io.ReadCloser, error)
+	// 删除文件，dir 为 true 时递归删除目录；不存在不算错
+	Del(ctx context.Context, rem string, dir bool) error
 	Mk(ctx context.Context, dir string) error
 	Cls()
 }
 
+// 上传源
+type Src struct {
+	R   io.Reader
+	L   string // 本地路径，用于日志
+	Sz  int64  // 压缩上传时大小未知，为 -1
+	Mt  time.Time
+	Rsm bool // 已记入续传日志，失败时保留远端的半截文件供下次续传
+}
+
+// 服务器能给出内容校验和时实现，返回 小写算法名 -> 小写十六进制
+type Sumer interface {
+	Sum(ctx context.Context, rem string) (map[string]string, error)
+}
+
+// 远端文件信息
+type Ent struct {
+	P   string
+	Sz  int64
+	Mt  time.Time
+	Dir bool
+}
+
+// 时间精度容差，FTP/FAT 只有秒级甚至 2 秒
+const mtTol = 2 * time.Second
+
+// newer 模式下本地文件是否需要重新上传，压缩、加密过的远端大小没法比。
+// 很多 WebDAV 服务器把上传时间当修改时间，不能拿本地时间和它比：有上次的记录 r 时，
+// 本地大小、时间和记录一致且远端时间没变就不传；没有记录时只在本地比远端新时重传
+func isNew(st os.FileInfo, e *Ent, z bool, r Rec, ok bool) bool {
+	if e == nil || e.Dir {
+		return true
+	}
+	if !z && st.Size() != e.Sz {
+		return true
+	}
+	if ok && r.Rt != 0 {
+		if r.Sz != st.Size() || r.Mt != st.ModTime().UnixNano() {
+			return true
+		}
+		if e.Mt.IsZero() {
+			return false
+		}
+		d := e.Mt.Sub(time.Unix(0, r.Rt))
+		return d < -mtTol || d > mtTol
+	}
+	// 拿不到远端时间时只比大小
+	if e.Mt.IsZero() {
+		return z
+	}
+	return st.ModTime().Sub(e.Mt) > mtTol
+}
+
+// 计数读过的字节，大小未知时日志用
+type cntR struct {
+	r io.Reader
+	n int64
+}
+
+func (c *cntR) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// 每次读之前看 ctx，取消后上传在下一块数据前停下
+type ctxR struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxR) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// 清理传了一半的远端文件的时限
+const rmTmo = 10 * time.Second
+
+// 删不掉的半截文件，调用方在续传日志里记下，下次不按远端已存在跳过
+var errPart = errors.New("partial remote file left")
+
+// 整传失败后删掉远端的半截文件，免得 skip 模式当成已传完；原 ctx 可能已取消，另起一个。
+// 返回上传的错误，删除失败时再带上 errPart
+func rmPart(sto Sto, rem string, err error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rmTmo)
+	defer cancel()
+	if e := sto.Del(ctx, rem, false); e != nil {
+		log.Printf("[WRN] remove partial %s: %v\n", rem, e)
+		return fmt.Errorf("%w; %w", err, errPart)
+	}
+	dbgLogf("[DBG] removed partial %s\n", rem)
+	return err
+}
+
 func mkSto(cfg *Cfg) (Sto, error) {
 	typ := strings.ToLower(strings.TrimSpace(cfg.Typ))
 	if typ == "" {
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStoE(t *testing.T) {
+	inner := errors.New("503 Service Unavailable")
+	e := fmt.Errorf("put a: %w", &StoE{Op: "put", P: "a", K: ErrTransient, Err: inner})
+	if !errors.Is(e, ErrTransient) || !errors.Is(e, inner) {
+		t.Errorf("%v: kind or cause lost", e)
+	}
+	if errors.Is(e, ErrAuth) {
+		t.Errorf("%v: unexpected ErrAuth", e)
+	}
+	if s := (&StoE{Op: "dial", Err: inner}).Error(); s != "dial: 503 Service Unavailable" {
+		t.Errorf("Error() = %q", s)
+	}
+}
+
+func TestNetK(t *testing.T) {
+	tc := []struct {
+		err error
+		k   error
+	}{
+		{io.EOF, ErrTransient},
+		{io.ErrUnexpectedEOF, ErrTransient},
+		{syscall.ECONNRESET, ErrTransient},
+		{&os.SyscallError{Syscall: "write", Err: syscall.EPIPE}, ErrTransient},
+		{&net.OpError{Op: "dial", Err: errors.New("refused")}, ErrTransient},
+		{context.Canceled, nil},
+		{errors.New("x"), nil},
+	}
+	for _, c := range tc {
+		if got := netK(c.err); got != c.k {
+			t.Errorf("netK(%v) = %v, want %v", c.err, got, c.k)
+		}
+	}
+}
+
+func TestErrKind(t *testing.T) {
+	tc := []struct {
+		err error
+		k   string
+	}{
+		{&StoE{K: ErrAuth, Err: errors.New("x")}, "auth"},
+		{&StoE{K: ErrPermission, Err: errors.New("x")}, "perm"},
+		{os.ErrPermission, "perm"},
+		{&StoE{K: ErrQuota, Err: errors.New("x")}, "quota"},
+		{&StoE{K: ErrNotFound, Err: errors.New("x")}, "notfound"},
+		{os.ErrNotExist, "notfound"},
+		{&StoE{K: ErrExists, Err: errors.New("x")}, "exists"},
+		{&StoE{K: ErrTransient, Err: errors.New("x")}, "transient"},
+		{io.EOF, "transient"},
+		{&StoE{Err: errors.New("400")}, "other"},
+		{errors.New("x"), "other"},
+	}
+	for _, c := range tc {
+		if got := errKind(c.err); got != c.k {
+			t.Errorf("errKind(%v) = %s, want %s", c.err, got, c.k)
+		}
+	}
+}
+
+// 远端时间是上传时间时，有记录就和上传后看到的远端时间比
+func TestIsNew(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "a")
+	if err := os.WriteFile(p, []byte("abc"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	lm := time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(p, lm, lm); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := lm.Add(time.Hour) // 服务器记的上传时间
+	rec := Rec{Sz: 3, Mt: st.ModTime().UnixNano(), Ok: true, Rt: up.UnixNano()}
+	tc := []struct {
+		name string
+		e    *Ent
+		z    bool
+		r    Rec
+		ok   bool
+		want bool
+	}{
+		{"missing", nil, false, Rec{}, false, true},
+		{"dir", &Ent{Dir: true}, false, Rec{}, false, true},
+		{"size", &Ent{Sz: 4, Mt: up}, false, rec, true, true},
+		{"same", &Ent{Sz: 3, Mt: up}, false, rec, true, false},
+		{"same zip", &Ent{Sz: 9, Mt: up.Add(time.Second)}, true, rec, true, false},
+		{"remote replaced", &Ent{Sz: 3, Mt: up.Add(time.Minute)}, false, rec, true, true},
+		{"local restored", &Ent{Sz: 3, Mt: up}, false, Rec{Sz: 3, Mt: lm.Add(time.Hour).UnixNano(), Ok: true, Rt: up.UnixNano()}, true, true},
+		{"no remote time", &Ent{Sz: 3}, false, rec, true, false},
+		{"no rec upload time", &Ent{Sz: 3, Mt: up}, false, Rec{}, false, false},
+		{"no rec local newer", &Ent{Sz: 3, Mt: lm.Add(-time.Hour)}, false, Rec{}, false, true},
+		{"no rec old rec", &Ent{Sz: 3, Mt: lm.Add(-time.Hour)}, false, Rec{Sz: 3, Mt: rec.Mt, Ok: true}, true, true},
+		{"no rec zip no time", &Ent{Sz: 9}, true, Rec{}, false, true},
+	}
+	for _, c := range tc {
+		if got := isNew(st, c.e, c.z, c.r, c.ok); got != c.want {
+			t.Errorf("%s: isNew = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
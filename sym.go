@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 符号链接清单，远端相对路径 -> 链接目标
+const symF = "links.json"
+
+// record 模式下收集的链接，nil 时不记录
+type SymL struct {
+	mu sync.Mutex
+	m  map[string]string
+}
+
+func (s *SymL) Add(rp, t string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.m[rp] = t
+	s.mu.Unlock()
+}
+
+// 符号链接：skip 跳过；follow 按目标备份，远端用链接自己的路径；record 记到清单，restore 时重建
+func (w *wk) sym(p, rp string, dep int) {
+	atomic.AddInt64(&stLnk, 1)
+	switch w.cfg.Sym {
+	case "follow":
+	case "record":
+		t, err := os.Readlink(p)
+		if err != nil {
+			log.Printf("[WRN] sym %s: %v\n", p, err)
+			return
+		}
+		if !w.cfg.flt.Ok(rp) {
+			atomic.AddInt64(&stFlt, 1)
+			logFlt(w.cfg, p, rp)
+			return
+		}
+		w.sl.Add(rp, filepath.ToSlash(t))
+		if w.cfg.Dry {
+			log.Printf("[PLAN] link %s -> %s\n", rp, t)
+		} else {
+			dbgLogf("[SYM] %s -> %s (record)\n", p, t)
+		}
+		return
+	default:
+		dbgLogf("[SYM] %s (skip)\n", p)
+		return
+	}
+
+	t, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		log.Printf("[WRN] sym %s: %v\n", p, err)
+		return
+	}
+	st, err := os.Stat(t)
+	if err != nil {
+		log.Printf("[WRN] sym %s -> %s: %v\n", p, t, err)
+		return
+	}
+	dbgLogf("[SYM] %s -> %s\n", p, t)
+	if st.Mode().IsRegular() {
+		w.file(t, rp, dep+1)
+		return
+	}
+	if !st.IsDir() {
+		return
+	}
+	// 指向自己的上级目录就是环
+	if d, err := filepath.EvalSymlinks(filepath.Dir(p)); err == nil &&
+		(d == t || strings.HasPrefix(d, t+string(filepath.Separator))) {
+		log.Printf("[WRN] sym %s -> %s: loop\n", p, t)
+		return
+	}
+	if dep >= maxDep || w.seen[t] {
+		log.Printf("[WRN] sym %s -> %s: loop or too deep\n", p, t)
+		return
+	}
+	if w.cfg.flt.Skp(rp) {
+		atomic.AddInt64(&stFlt, 1)
+		logFlt(w.cfg, p, rp)
+		return
+	}
+	if err := w.walk(t, rp, dep+1); err != nil {
+		log.Printf("[WRN] sym %s -> %s: %v\n", p, t, err)
+	}
+}
+
+// 上传本次的链接清单，没有链接时也上传空清单，免得恢复出已删掉的链接
+func putSym(ctx context.Context, cfg *Cfg, rs *Rs) error {
+	rs.sl.mu.Lock()
+	n := len(rs.sl.m)
+	b, err := json.MarshalIndent(rs.sl.m, "", "  ")
+	rs.sl.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	rem := remP(cfg, ctlDir+"/"+symF)
+	if cfg.Dry {
+		log.Printf("[PLAN] upload %s (%d links)\n", rem, n)
+		return nil
+	}
+
+	sto, err := mkSto(cfg)
+	if err != nil {
+		return err
+	}
+	defer sto.Cls()
+
+	if err := putB(ctx, sto, rs.dc, rem, b); err != nil {
+		return err
+	}
+	dbgLogf("[SYM] %s (%d links)\n", rem, n)
+	return nil
+}
+
+// 取离 src 最近的链接清单，返回清单所在目录
+func rdSym(ctx context.Context, sto Sto, src, top string) (string, map[string]string, error) {
+	d, e, err := ctlUp(ctx, sto, src, top, symF)
+	if err != nil || e == nil || e.Dir {
+		return "", nil, err
+	}
+	rem := path.Join(d, ctlDir, symF)
+	rc, err := sto.Get(ctx, rem)
+	if err != nil {
+		return "", nil, fmt.Errorf("get %s: %w", rem, err)
+	}
+	defer rc.Close()
+	m := make(map[string]string)
+	if err := json.NewDecoder(rc).Decode(&m); err != nil {
+		return "", nil, fmt.Errorf("read %s: %w", rem, err)
+	}
+	return d, m, nil
+}
+
+// 按清单在 dst 下重建 src 范围内的链接
+func rstSym(ctx context.Context, sto Sto, cfg *Cfg, src, dst string, skp bool) error {
+	md, m, err := rdSym(ctx, sto, src, strings.Trim(cfg.Root, "/"))
+	if err != nil || m == nil {
+		return err
+	}
+	for k, t := range m {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel := strings.Trim(path.Join(md, k), "/")
+		if src != "" {
+			if !strings.HasPrefix(rel, src+"/") {
+				continue
+			}
+			rel = strings.TrimPrefix(rel, src+"/")
+		}
+		lp, err := locP(dst, rel)
+		if err != nil {
+			atomic.AddInt64(&stErr, 1)
+			log.Printf("[ERR] %v\n", err)
+			continue
+		}
+		if _, err := os.Lstat(lp); err == nil {
+			if skp {
+				atomic.AddInt64(&stSkp, 1)
+				log.Printf("[SKIP] %s\n", lp)
+				continue
+			}
+			if err := os.Remove(lp); err != nil {
+				atomic.AddInt64(&stErr, 1)
+				log.Printf("[ERR] %v\n", err)
+				continue
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(lp), 0o755); err != nil {
+			return err
+		}
+		if err := os.Symlink(filepath.FromSlash(t), lp); err != nil {
+			atomic.AddInt64(&stErr, 1)
+			log.Printf("[ERR] %v\n", err)
+			continue
+		}
+		atomic.AddInt64(&stLnk, 1)
+		dbgLogf("[SYM] %s -> %s\n", lp, t)
+	}
+	return nil
+}
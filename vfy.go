@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"strings"
+)
+
+// 服务器不提供校验和，只比大小
+var errNoSum = errors.New("checksum unsupported")
+
+// 边上传边计数和算哈希
+type hsW struct {
+	n int64
+	m map[string]hash.Hash
+}
+
+func mkHs() *hsW {
+	return &hsW{m: map[string]hash.Hash{
+		"md5":     md5.New(),
+		"sha1":    sha1.New(),
+		"adler32": adler32.New(),
+	}}
+}
+
+func (h *hsW) Write(p []byte) (int, error) {
+	h.n += int64(len(p))
+	for _, x := range h.m {
+		x.Write(p)
+	}
+	return len(p), nil
+}
+
+// 上传后校验：先比远端大小，服务器支持时再比校验和
+func vfy(ctx context.Context, sto Sto, rem string, h *hsW) error {
+	e, err := sto.Stat(ctx, rem)
+	if err != nil {
+		return fmt.Errorf("verify %s: %w", rem, err)
+	}
+	if e == nil {
+		return fmt.Errorf("verify %s: missing", rem)
+	}
+	if e.Sz != h.n {
+		return fmt.Errorf("verify %s: size %d != %d", rem, e.Sz, h.n)
+	}
+
+	sm, ok := sto.(Sumer)
+	if !ok {
+		return nil
+	}
+	rs, err := sm.Sum(ctx, rem)
+	if errors.Is(err, errNoSum) {
+		dbgLogf("[VFY] %s: no server checksum, size only\n", rem)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("verify %s: %w", rem, err)
+	}
+	for alg, v := range rs {
+		x, ok := h.m[alg]
+		if !ok {
+			continue
+		}
+		lv := hex.EncodeToString(x.Sum(nil))
+		if lv != v {
+			return fmt.Errorf("verify %s: %s %s != %s", rem, alg, v, lv)
+		}
+		dbgLogf("[VFY] %s %s ok\n", rem, alg)
+		return nil
+	}
+	return nil
+}
+
+// 解析 "SHA1:abc MD5:def" 这类校验和串
+func prsSum(s string, m map[string]string) {
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ' ' || r == ',' || r == '\t' || r == '\n'
+	}) {
+		i := strings.IndexByte(f, ':')
+		if i <= 0 {
+			continue
+		}
+		alg := strings.ToLower(strings.ReplaceAll(f[:i], "-", ""))
+		m[alg] = strings.ToLower(f[i+1:])
+	}
+}
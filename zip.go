@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// 压缩上传的远端后缀，gzip 头的 Comment 写 zipTag，restore 据此区分用户自己的 .gz
+const (
+	zipSuf = ".gz"
+	zipTag = "wdbak"
+)
+
+// 默认不压缩的后缀，已是压缩格式
+var defZipExc = []string{
+	".gz", ".tgz", ".zip", ".7z", ".rar", ".xz", ".bz2", ".zst", ".lz4",
+	".jpg", ".jpeg", ".png", ".gif", ".webp", ".heic",
+	".mp3", ".m4a", ".aac", ".flac", ".mp4", ".mkv", ".mov", ".avi", ".webm",
+	".docx", ".xlsx", ".pptx", ".pdf", ".apk", ".jar",
+}
+
+// 按后缀建排除表，未配置时用默认表
+func mkZipExc(ss []string) map[string]struct{} {
+	if len(ss) == 0 {
+		ss = defZipExc
+	}
+	m := make(map[string]struct{}, len(ss))
+	for _, s := range ss {
+		if e := normExt(s); e != "" {
+			m[e] = struct{}{}
+		}
+	}
+	return m
+}
+
+// 远端路径，需要压缩时加后缀
+func zipRem(cfg *Cfg, rem string) (string, bool) {
+	if cfg.Zip == "" {
+		return rem, false
+	}
+	if _, ok := cfg.zexc[strings.ToLower(path.Ext(rem))]; ok {
+		return rem, false
+	}
+	return rem + zipSuf, true
+}
+
+// 边读边压缩，调用方必须 Close，提前 Close 时后台 goroutine 随之退出
+func gzR(r io.Reader, name string, mt time.Time) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		zw.Name = name
+		zw.ModTime = mt
+		zw.Comment = zipTag
+		_, err := io.Copy(zw, r)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// 先看 gzip 头，是本程序压缩的才解压，返回解压流和原修改时间
+func unZip(r io.Reader) (io.Reader, time.Time, bool) {
+	br := bufio.NewReaderSize(r, 4096)
+	h, _ := br.Peek(4096)
+	zh, err := gzip.NewReader(bytes.NewReader(h))
+	if err != nil || zh.Comment != zipTag {
+		return br, time.Time{}, false
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return br, time.Time{}, false
+	}
+	return zr, zr.ModTime, true
+}